@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// loopbacks are the only clients allowed when no allow list is given.
+var loopbacks = []string{"127.0.0.0/8", "::1/128"}
+
+// acl tells which client addresses may use the local listeners. Deny takes
+// precedence over allow.
+type acl struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// newACL parses lists of CIDRs or single IPs, eg: "192.168.0.0/16", "10.0.0.1".
+func newACL(allow, deny []string) (*acl, error) {
+	if len(allow) == 0 {
+		allow = loopbacks
+	}
+	a := &acl{}
+	var err error
+	if a.allow, err = parseCIDRs(allow); err != nil {
+		return nil, err
+	}
+	if a.deny, err = parseCIDRs(deny); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func parseCIDRs(specs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(specs))
+	for _, spec := range specs {
+		if !strings.Contains(spec, "/") {
+			ip := net.ParseIP(spec)
+			if ip == nil {
+				return nil, fmt.Errorf("Invalid client address %s", spec)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				bits = 32
+			}
+			spec = fmt.Sprintf("%s/%d", spec, bits)
+		}
+		_, n, err := net.ParseCIDR(spec)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid client address %s, %s", spec, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowed tells whether the client at addr is allowed, logging it when not.
+// Clients of unix sockets are left to the socket permissions.
+func (a *acl) allowed(addr net.Addr) bool {
+	var ip net.IP
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		ip = addr.IP
+	case *net.UDPAddr:
+		ip = addr.IP
+	default:
+		return true
+	}
+	if containsIP(a.deny, ip) || !containsIP(a.allow, ip) {
+		log.Warnf("Client %s is not allowed", addr.String())
+		return false
+	}
+	return true
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestNewACL(t *testing.T) {
+	tests := []struct {
+		allow, deny []string
+		err         bool
+	}{
+		{nil, nil, false},
+		{[]string{"192.168.0.0/16", "10.0.0.1", "fd00::/8", "2001:db8::1"}, []string{"192.168.1.13"}, false},
+		{[]string{"192.168.0.0/33"}, nil, true},
+		{[]string{"192.168.0.300"}, nil, true},
+		{nil, []string{"example.com"}, true},
+		{nil, []string{""}, true},
+	}
+	for _, tt := range tests {
+		if _, err := newACL(tt.allow, tt.deny); (err != nil) != tt.err {
+			t.Errorf("newACL(%v, %v) error %v, want error %v", tt.allow, tt.deny, err, tt.err)
+		}
+	}
+}
+
+func TestACLAllowed(t *testing.T) {
+	loopback, err := newACL(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lan, err := newACL([]string{"192.168.1.0/24", "10.0.0.1", "fd00::/8"}, []string{"192.168.1.13", "192.168.1.128/25", "fd00::13"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcp := func(ip string) net.Addr { return &net.TCPAddr{IP: net.ParseIP(ip), Port: 40000} }
+	udp := func(ip string) net.Addr { return &net.UDPAddr{IP: net.ParseIP(ip), Port: 40000} }
+
+	tests := []struct {
+		acl  *acl
+		addr net.Addr
+		want bool
+	}{
+		{loopback, tcp("127.0.0.1"), true},
+		{loopback, tcp("127.1.2.3"), true},
+		{loopback, tcp("::1"), true},
+		{loopback, tcp("::ffff:127.0.0.1"), true},
+		{loopback, tcp("192.168.1.5"), false},
+		{loopback, udp("192.168.1.5"), false},
+		{loopback, &net.UnixAddr{Name: "/run/away.sock", Net: "unix"}, true},
+		{lan, tcp("192.168.1.5"), true},
+		{lan, udp("192.168.1.5"), true},
+		{lan, tcp("::ffff:192.168.1.5"), true},
+		{lan, tcp("192.168.1.13"), false},
+		{lan, tcp("192.168.1.127"), true},
+		{lan, tcp("192.168.1.128"), false},
+		{lan, tcp("192.168.2.5"), false},
+		{lan, tcp("10.0.0.1"), true},
+		{lan, tcp("10.0.0.2"), false},
+		{lan, tcp("127.0.0.1"), false},
+		{lan, tcp("fd00::1"), true},
+		{lan, tcp("fd00::13"), false},
+		{lan, tcp("fe80::1"), false},
+	}
+	for _, tt := range tests {
+		if got := tt.acl.allowed(tt.addr); got != tt.want {
+			t.Errorf("allowed(%s) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	methodNoAuth       = 0
+	methodUserPass     = 2
+	methodNoAcceptable = 0xff
+)
+
+var errAuthFailed = errors.New("authentication failed")
+
+// account is a user of the users file, routed in its own mode when non zero.
+type account struct {
+	pass string
+	mode rune
+}
+
+// LoadUsers reads credentials from filename, one "user:password" per line,
+// optionally prefixed by the mode the user is routed in, eg: "~alice:secret".
+func LoadUsers(filename string) (map[string]account, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	users := make(map[string]account)
+	s := bufio.NewScanner(file)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		var mode rune
+		switch m := rune(line[0]); m {
+		case ModeRule, ModeAway, ModePass, ModeDrop:
+			mode = m
+			line = line[1:]
+		}
+		i := strings.IndexRune(line, ':')
+		if i <= 0 {
+			log.Warnf("Invalid user line: %s", line)
+			continue
+		}
+		users[line[:i]] = account{line[i+1:], mode}
+	}
+	return users, s.Err()
+}
+
+// selectMethod picks the authentication method among the offered ones.
+func selectMethod(methods []byte, auth bool) byte {
+	want := byte(methodNoAuth)
+	if auth {
+		want = methodUserPass
+	}
+	if bytes.IndexByte(methods, want) < 0 {
+		return methodNoAcceptable
+	}
+	return want
+}
+
+// authenticate runs the username/password subnegotiation https://tools.ietf.org/html/rfc1929
+func authenticate(conn net.Conn, users map[string]account) (string, error) {
+	// +----+------+----------+------+----------+
+	// |VER | ULEN |  UNAME   | PLEN |  PASSWD  |
+	// +----+------+----------+------+----------+
+	// | 1  |  1   | 1 to 255 |  1   | 1 to 255 |
+	// +----+------+----------+------+----------+
+
+	buf := make([]byte, 256)
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return "", err
+	}
+	if buf[0] != 1 {
+		return "", errAuthFailed
+	}
+	ulen := int(buf[1])
+	if _, err := io.ReadFull(conn, buf[:ulen]); err != nil {
+		return "", err
+	}
+	user := string(buf[:ulen])
+	if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+		return "", err
+	}
+	plen := int(buf[0])
+	if _, err := io.ReadFull(conn, buf[:plen]); err != nil {
+		return "", err
+	}
+	pass := buf[:plen]
+
+	// +----+--------+
+	// |VER | STATUS |
+	// +----+--------+
+	// | 1  |   1    |
+	// +----+--------+
+
+	if !checkUser(users, user, string(pass)) {
+		conn.Write([]byte{1, 1})
+		return user, errAuthFailed
+	}
+	if _, err := conn.Write([]byte{1, 0}); err != nil {
+		return user, err
+	}
+	return user, nil
+}
+
+func checkUser(users map[string]account, user, pass string) bool {
+	a, ok := users[user]
+	return ok && subtle.ConstantTimeCompare([]byte(a.pass), []byte(pass)) == 1
+}
+
+// userMode is the mode the connections of user are routed in, the mode of
+// their listener unless the user has one.
+func userMode(users map[string]account, user string, mode rune) rune {
+	if m := users[user].mode; m != 0 {
+		return m
+	}
+	return mode
+}
+
+// userConn is a client connection authenticated as user.
+type userConn struct {
+	net.Conn
+	user string
+}
+
+// clientName names the client behind conn for logging.
+func clientName(conn net.Conn) string {
+	if uc, ok := conn.(*userConn); ok {
+		return uc.user + "@" + uc.RemoteAddr().String()
+	}
+	return conn.RemoteAddr().String()
+}
+
+// connUser is the user conn is authenticated as, if any.
+func connUser(conn net.Conn) string {
+	if uc, ok := conn.(*userConn); ok {
+		return uc.user
+	}
+	return ""
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestLoadUsers(t *testing.T) {
+	f, err := ioutil.TempFile("", "users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("# users\nbob:secret\n~alice:a:b\n!guest:guest\n\ninvalid\n:nobody\n")
+	f.Close()
+
+	users, err := LoadUsers(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 3 {
+		t.Fatalf("LoadUsers = %v, want 3 users", users)
+	}
+	tests := []struct {
+		user, pass string
+		ok         bool
+		mode       rune
+	}{
+		{"bob", "secret", true, ModePass},
+		{"bob", "Secret", false, ModePass},
+		{"alice", "a:b", true, ModeAway},
+		{"guest", "guest", true, ModeDrop},
+		{"~alice", "a:b", false, ModePass},
+		{"carol", "", false, ModePass},
+	}
+	for _, tt := range tests {
+		if ok := checkUser(users, tt.user, tt.pass); ok != tt.ok {
+			t.Errorf("checkUser(%s, %s) = %v, want %v", tt.user, tt.pass, ok, tt.ok)
+		}
+		if m := userMode(users, tt.user, ModePass); m != tt.mode {
+			t.Errorf("userMode(%s) = %c, want %c", tt.user, m, tt.mode)
+		}
+	}
+}
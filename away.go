@@ -8,6 +8,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -45,6 +46,7 @@ type Away struct {
 	rules    sync.Map
 	mode     rune
 	filename string
+	pac      atomic.Value
 }
 
 func NewAway(mode rune, filename string) *Away {
@@ -52,6 +54,7 @@ func NewAway(mode rune, filename string) *Away {
 		mode:     mode,
 		filename: filename,
 	}
+	a.refreshPAC()
 	return a
 }
 
@@ -64,7 +67,16 @@ func (a *Away) ChangeMode(m rune) {
 }
 
 func (a *Away) ResloveMode(addr *Addr) rune {
-	if a.mode == ModeRule {
+	return a.ResloveModeWith(a.mode, addr)
+}
+
+// ResloveModeWith resolves addr as if mode were the current mode, zero
+// meaning the current mode.
+func (a *Away) ResloveModeWith(mode rune, addr *Addr) rune {
+	if mode == 0 {
+		mode = a.mode
+	}
+	if mode == ModeRule {
 		s := addr.Host()
 		for {
 			if r, ok := a.rules.Load(s); ok {
@@ -78,7 +90,7 @@ func (a *Away) ResloveMode(addr *Addr) rune {
 			}
 		}
 	} else {
-		return a.mode
+		return mode
 	}
 }
 
@@ -88,11 +100,13 @@ func (a *Away) AddRule(r string) error {
 		return err
 	}
 	a.rules.Store(nr.Rule, nr)
+	a.refreshPAC()
 	return nil
 }
 
 func (a *Away) DeleteRule(r string) {
 	a.rules.Delete(r[1:])
+	a.refreshPAC()
 }
 
 func (a *Away) SortRules() []string {
@@ -125,6 +139,7 @@ func (a *Away) LoadRules() (int, error) {
 		a.rules.Store(nr.Rule, nr)
 		i++
 	}
+	a.refreshPAC()
 	return i, nil
 }
 
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"net"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const bindTimeout = 120 * time.Second
+
+// bind serves a BIND request. The first reply carries the address we
+// listen on, the second one the address of the inbound connection.
+func (s *SocksSrv) bind(oc net.Conn, addr *Addr, mode rune) {
+	log.Infof("%c BIND %s->%s", mode, clientName(oc), addr.String())
+	oc.SetDeadline(time.Time{}) // handshake done
+
+	var ac net.Conn
+	var peer *Addr
+	var err error
+	switch mode {
+	case ModeDrop:
+		reply(oc, repNotAllowed, nil)
+		return
+	case ModeAway:
+		ac, peer, err = s.bindRemote(oc, addr)
+	default:
+		ac, peer, err = acceptBind(oc, connIP(oc.LocalAddr()))
+	}
+	if err != nil {
+		log.Warnf("Bind %c %s failure: %s", mode, addr.String(), err)
+		return
+	}
+	defer ac.Close()
+
+	if _, err := reply(oc, repSucceeded, peer); err != nil {
+		return
+	}
+
+	nout, nin, err := relay(ac, oc)
+	if err != nil {
+		log.Warn("Relay bind failure: ", err)
+	}
+	log.Infof("%c BIND %s<-%s <%d %d>", mode, clientName(oc), peer.String(), nin, nout)
+}
+
+// bindRemote asks the remote to listen and forwards its first reply.
+func (s *SocksSrv) bindRemote(oc net.Conn, addr *Addr) (net.Conn, *Addr, error) {
+	ac, bnd, err := s.dialTunnel(cmdBind, addr)
+	if err != nil {
+		reply(oc, repCode(err), nil)
+		return nil, nil, err
+	}
+	if _, err := reply(oc, repSucceeded, bnd); err != nil {
+		ac.Close()
+		return nil, nil, err
+	}
+	peer, err := readReply(ac, "tcp")
+	if err != nil {
+		reply(oc, repCode(err), nil)
+		ac.Close()
+		return nil, nil, err
+	}
+	return ac, peer, nil
+}
+
+// acceptBind listens on ip, sends the first reply to conn and waits for
+// a single inbound connection.
+func acceptBind(conn net.Conn, ip net.IP) (net.Conn, *Addr, error) {
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: ip})
+	if err != nil {
+		reply(conn, repGeneralFailure, nil)
+		return nil, nil, err
+	}
+	defer l.Close()
+
+	bnd, err := NewAddr("tcp", l.Addr().String())
+	if err != nil {
+		reply(conn, repGeneralFailure, nil)
+		return nil, nil, err
+	}
+	if _, err := reply(conn, repSucceeded, bnd); err != nil {
+		return nil, nil, err
+	}
+
+	l.SetDeadline(time.Now().Add(bindTimeout))
+	ac, err := l.AcceptTCP()
+	if err != nil {
+		reply(conn, repCode(err), nil)
+		return nil, nil, err
+	}
+	peer, err := NewAddr("tcp", ac.RemoteAddr().String())
+	if err != nil {
+		reply(conn, repGeneralFailure, nil)
+		ac.Close()
+		return nil, nil, err
+	}
+	keepAlive(ac)
+	return ac, peer, nil
+}
+
+// relayBind serves a BIND tunnel on the remote, listening on ip.
+func relayBind(wss net.Conn, ip net.IP) {
+	tc, peer, err := acceptBind(wss, ip)
+	if err != nil {
+		log.Warn("Bind accept failure: ", err)
+		return
+	}
+	defer tc.Close()
+
+	if _, err := reply(wss, repSucceeded, peer); err != nil {
+		return
+	}
+	if nout, nin, err := relay(tc, wss); err != nil {
+		log.Warn("Relay bind failure: ", err)
+	} else {
+		log.Infof("Away BIND: %s ~ %s <%d %d>", clientName(wss), peer.String(), nin, nout)
+	}
+}
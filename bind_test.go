@@ -0,0 +1,107 @@
+package main
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// bindPeer connects to the address of a first BIND reply, as the server
+// of an active FTP session would.
+func bindPeer(t *testing.T, bnd *Addr) net.Conn {
+	c, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(bnd.Port())), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestBind(t *testing.T) {
+	tests := []struct {
+		mode rune
+		rep  byte // of the first reply
+	}{
+		{ModePass, repSucceeded},
+		{ModeRule, repSucceeded},
+		{ModeDrop, repNotAllowed},
+	}
+	for _, tt := range tests {
+		c, oc := net.Pipe()
+		s := &SocksSrv{}
+		addr, _ := NewAddr("tcp", "192.0.2.1:21")
+		done := make(chan struct{})
+		go func() {
+			s.bind(oc, addr, tt.mode)
+			oc.Close()
+			close(done)
+		}()
+
+		bnd, err := readReply(c, "tcp")
+		if tt.rep != repSucceeded {
+			if err == nil {
+				t.Errorf("%c: first reply succeeded, want %d", tt.mode, tt.rep)
+			}
+			c.Close()
+			<-done
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%c: first reply: %v", tt.mode, err)
+		}
+
+		pc := bindPeer(t, bnd)
+		peer, err := readReply(c, "tcp")
+		if err != nil {
+			t.Fatalf("%c: second reply: %v", tt.mode, err)
+		}
+		if peer.String() != pc.LocalAddr().String() {
+			t.Errorf("%c: second reply %s, want the peer %s", tt.mode, peer, pc.LocalAddr())
+		}
+
+		// Relayed both ways
+		go pc.Write([]byte("220 ready"))
+		b := make([]byte, 9)
+		if _, err := io.ReadFull(c, b); err != nil || string(b) != "220 ready" {
+			t.Errorf("%c: client read %q, %v", tt.mode, b, err)
+		}
+		go c.Write([]byte("USER"))
+		if _, err := io.ReadFull(pc, b[:4]); err != nil || string(b[:4]) != "USER" {
+			t.Errorf("%c: peer read %q, %v", tt.mode, b[:4], err)
+		}
+		pc.Close()
+		c.Close()
+		<-done
+	}
+}
+
+func TestRelayBind(t *testing.T) {
+	c, wss := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		relayBind(wss, net.IPv4(127, 0, 0, 1))
+		wss.Close()
+		close(done)
+	}()
+
+	bnd, err := readReply(c, "tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bnd.Host() != "127.0.0.1" {
+		t.Errorf("bound %s, want on 127.0.0.1", bnd)
+	}
+	pc := bindPeer(t, bnd)
+	if peer, err := readReply(c, "tcp"); err != nil || peer.String() != pc.LocalAddr().String() {
+		t.Fatalf("second reply %v, %v, want %s", peer, err, pc.LocalAddr())
+	}
+	go pc.Write([]byte("ok"))
+	b := make([]byte, 2)
+	if _, err := io.ReadFull(c, b); err != nil || string(b) != "ok" {
+		t.Errorf("read %q, %v", b, err)
+	}
+	c.Close()
+	pc.Close()
+	<-done
+}
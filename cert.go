@@ -0,0 +1,367 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const selfSignedValidity = 10 * 365 * 24 * time.Hour
+
+var (
+	errPinMismatch  = errors.New("remote certificate matches no pin")
+	errNoClientCert = errors.New("no client certificate")
+	errCertRevoked  = errors.New("client certificate revoked")
+)
+
+// certStore holds the certificate the remote serves TLS with, and the CAs
+// and revocation list client certificates are verified with, reloaded from
+// their files on SIGHUP.
+type certStore struct {
+	certFile string
+	keyFile  string
+	caFile   string
+	crlFile  string
+
+	mu      sync.RWMutex
+	conf    *tls.Config
+	revoked map[string]bool // by revokedKey
+}
+
+// loadCertStore loads the certificate of certFile and keyFile, generating
+// a self-signed one into them when neither exists. Clients are required a
+// certificate of the CAs of caFile when given, not revoked by crlFile.
+func loadCertStore(certFile, keyFile, caFile, crlFile string) (*certStore, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("Both a certificate and a key file are needed for TLS")
+	}
+	if crlFile != "" && caFile == "" {
+		return nil, fmt.Errorf("A revocation list needs a client CA file")
+	}
+	_, certErr := os.Stat(certFile)
+	_, keyErr := os.Stat(keyFile)
+	if os.IsNotExist(certErr) && os.IsNotExist(keyErr) {
+		if err := generateCert(certFile, keyFile); err != nil {
+			return nil, fmt.Errorf("Self-signed certificate generation failure: %s", err)
+		}
+		log.Infof("Generated a self-signed certificate in %s", certFile)
+	}
+
+	s := &certStore{certFile: certFile, keyFile: keyFile, caFile: caFile, crlFile: crlFile}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	go s.reloadOnHUP()
+	return s, nil
+}
+
+func (s *certStore) load() error {
+	cert, err := tls.LoadX509KeyPair(s.certFile, s.keyFile)
+	if err != nil {
+		return err
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return err
+	}
+	conf := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"h2", "http/1.1", streamALPN},
+	}
+
+	var revoked map[string]bool
+	if s.caFile != "" {
+		cas, err := loadCerts(s.caFile)
+		if err != nil {
+			return err
+		}
+		conf.ClientAuth = tls.RequireAndVerifyClientCert
+		conf.ClientCAs = x509.NewCertPool()
+		for _, ca := range cas {
+			conf.ClientCAs.AddCert(ca)
+		}
+		conf.VerifyPeerCertificate = s.verifyClient
+		if s.crlFile != "" {
+			if revoked, err = loadCRL(s.crlFile, cas); err != nil {
+				return err
+			}
+		}
+	}
+
+	s.mu.Lock()
+	s.conf = conf
+	s.revoked = revoked
+	s.mu.Unlock()
+	log.Infof("TLS certificate %s, pin %s", cert.Leaf.Subject.CommonName, spkiPin(cert.Leaf))
+	if s.caFile != "" {
+		log.Infof("Client certificates required, [%d] revoked", len(revoked))
+	}
+	return nil
+}
+
+func (s *certStore) reloadOnHUP() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	for range c {
+		if err := s.load(); err != nil {
+			log.Error("TLS certificate reload failure: ", err)
+		}
+	}
+}
+
+func (s *certStore) get(*tls.ClientHelloInfo) (*tls.Config, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.conf, nil
+}
+
+// verifyClient rejects the revoked client certificates, their chain being
+// verified already.
+func (s *certStore) verifyClient(_ [][]byte, chains [][]*x509.Certificate) error {
+	if len(chains) == 0 {
+		return errNoClientCert
+	}
+	leaf := chains[0][0]
+	s.mu.RLock()
+	revoked := s.revoked[revokedKey(leaf.RawIssuer, leaf.SerialNumber)]
+	s.mu.RUnlock()
+	if revoked {
+		log.Warnf("Client certificate of %s revoked", certUser(leaf))
+		return errCertRevoked
+	}
+	return nil
+}
+
+// tlsConfig is the TLS the remote serves, with the protocols of its
+// transports.
+func (s *certStore) tlsConfig() *tls.Config {
+	return &tls.Config{GetConfigForClient: s.get}
+}
+
+// loadCerts reads the PEM certificates of filename.
+func loadCerts(filename string) ([]*x509.Certificate, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		if block, b = pem.Decode(b); block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("No certificate found in %s", filename)
+	}
+	return certs, nil
+}
+
+// loadCRL reads the certificates revoked by the PEM or DER revocation list
+// of filename, which one of cas must have signed.
+func loadCRL(filename string, cas []*x509.Certificate) (map[string]bool, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	crl, err := x509.ParseCRL(b)
+	if err != nil {
+		return nil, fmt.Errorf("Revocation list %s parse failure: %s", filename, err)
+	}
+	var issuer *x509.Certificate
+	for _, ca := range cas {
+		if ca.CheckCRLSignature(crl) == nil {
+			issuer = ca
+			break
+		}
+	}
+	if issuer == nil {
+		return nil, fmt.Errorf("Revocation list %s not signed by a client CA", filename)
+	}
+	if crl.HasExpired(time.Now()) {
+		log.Warnf("Revocation list %s expired, still honoured", filename)
+	}
+
+	revoked := make(map[string]bool, len(crl.TBSCertList.RevokedCertificates))
+	for _, rc := range crl.TBSCertList.RevokedCertificates {
+		revoked[revokedKey(issuer.RawSubject, rc.SerialNumber)] = true
+	}
+	return revoked, nil
+}
+
+// revokedKey tells certificates apart by issuer, serials being only unique
+// per CA.
+func revokedKey(issuer []byte, serial *big.Int) string {
+	return string(issuer) + "/" + serial.String()
+}
+
+// certUser names the user of a client certificate by its subject.
+func certUser(cert *x509.Certificate) string {
+	if cert.Subject.CommonName != "" {
+		return cert.Subject.CommonName
+	}
+	if len(cert.EmailAddresses) > 0 {
+		return cert.EmailAddresses[0]
+	}
+	return cert.Subject.String()
+}
+
+// withCertUser authenticates conn as the user of the client certificate
+// of state, if any.
+func withCertUser(conn net.Conn, state *tls.ConnectionState) net.Conn {
+	if state == nil || len(state.PeerCertificates) == 0 {
+		return conn
+	}
+	return &userConn{conn, certUser(state.PeerCertificates[0])}
+}
+
+// generateCert writes a self-signed certificate for the host name and
+// loopback, with its key.
+func generateCert(certFile, keyFile string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		host = "localhost"
+	}
+
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: host},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              []string{host, "localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	if err := ioutil.WriteFile(keyFile, keyPem, 0600); err != nil {
+		return err
+	}
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	return ioutil.WriteFile(certFile, certPem, 0644)
+}
+
+// spkiPin is the pin of the public key of cert, eg: "sha256/47DEQpj8...".
+func spkiPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return "sha256/" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// clientTLSConfig is the TLS local verifies the remote with: against the
+// CAs of caFile instead of the system ones when given, and by pins of the
+// certificate keys. Pins alone trust the key of the remote certificate
+// without verifying its chain, as for self-signed ones. The certificate of
+// certFile and keyFile is presented to remotes requiring one.
+func clientTLSConfig(caFile string, pins []string, certFile, keyFile string) (*tls.Config, error) {
+	conf := &tls.Config{}
+	if certFile != "" || keyFile != "" {
+		if certFile == "" || keyFile == "" {
+			return nil, fmt.Errorf("Both a client certificate and a key file are needed")
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+	if caFile != "" {
+		b, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		conf.RootCAs = x509.NewCertPool()
+		if !conf.RootCAs.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("No certificate found in %s", caFile)
+		}
+	}
+	if len(pins) == 0 {
+		return conf, nil
+	}
+
+	set := make(map[string]bool, len(pins))
+	for _, p := range pins {
+		if !strings.HasPrefix(p, "sha256/") {
+			p = "sha256/" + p
+		}
+		if b, err := base64.StdEncoding.DecodeString(p[len("sha256/"):]); err != nil || len(b) != sha256.Size {
+			return nil, fmt.Errorf("Invalid pin %s, want sha256/base64", p)
+		}
+		set[p] = true
+	}
+
+	if caFile == "" {
+		conf.InsecureSkipVerify = true
+		conf.VerifyPeerCertificate = func(raw [][]byte, _ [][]*x509.Certificate) error {
+			if len(raw) == 0 {
+				return errPinMismatch
+			}
+			leaf, err := x509.ParseCertificate(raw[0])
+			if err != nil {
+				return err
+			}
+			if !set[spkiPin(leaf)] {
+				return errPinMismatch
+			}
+			return nil
+		}
+		return conf, nil
+	}
+
+	conf.VerifyPeerCertificate = func(_ [][]byte, chains [][]*x509.Certificate) error {
+		for _, chain := range chains {
+			for _, cert := range chain {
+				if set[spkiPin(cert)] {
+					return nil
+				}
+			}
+		}
+		return errPinMismatch
+	}
+	return conf, nil
+}
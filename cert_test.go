@@ -0,0 +1,247 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert, key}
+}
+
+func (ca *testCA) issue(t *testing.T, user string, serial int64) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: user},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func (ca *testCA) crl(t *testing.T, dir string, serials ...int64) string {
+	var revoked []pkix.RevokedCertificate
+	for _, s := range serials {
+		revoked = append(revoked, pkix.RevokedCertificate{SerialNumber: big.NewInt(s), RevocationTime: time.Now()})
+	}
+	der, err := ca.cert.CreateCRL(rand.Reader, ca.key, revoked, time.Now(), time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(dir, ca.cert.Subject.CommonName+".crl")
+	if err := ioutil.WriteFile(filename, der, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestRevocationByIssuer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "away")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca1, ca2 := newTestCA(t, "ca1"), newTestCA(t, "ca2")
+	cas := []*x509.Certificate{ca1.cert, ca2.cert}
+	revoked, err := loadCRL(ca1.crl(t, dir, 7), cas)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &certStore{revoked: revoked}
+
+	tests := []struct {
+		ca     *testCA
+		user   string
+		serial int64
+		want   error
+	}{
+		{ca1, "bob", 7, errCertRevoked},
+		{ca1, "alice", 8, nil},
+		{ca2, "carol", 7, nil},
+	}
+	for _, tt := range tests {
+		leaf := tt.ca.issue(t, tt.user, tt.serial)
+		chains := [][]*x509.Certificate{{leaf, tt.ca.cert}}
+		if err := s.verifyClient(nil, chains); err != tt.want {
+			t.Errorf("verifyClient(%s of %s) = %v, want %v", tt.user, tt.ca.cert.Subject.CommonName, err, tt.want)
+		}
+	}
+
+	if _, err := loadCRL(newTestCA(t, "ca3").crl(t, dir, 7), cas); err == nil {
+		t.Error("loadCRL of a foreign CA succeeded")
+	}
+}
+
+func TestCertUser(t *testing.T) {
+	tests := []struct {
+		cert *x509.Certificate
+		want string
+	}{
+		{&x509.Certificate{Subject: pkix.Name{CommonName: "alice"}, EmailAddresses: []string{"a@example.com"}}, "alice"},
+		{&x509.Certificate{EmailAddresses: []string{"a@example.com"}}, "a@example.com"},
+		{&x509.Certificate{Subject: pkix.Name{Organization: []string{"Away"}}}, "O=Away"},
+	}
+	for _, tt := range tests {
+		if got := certUser(tt.cert); got != tt.want {
+			t.Errorf("certUser = %q, want %q", got, tt.want)
+		}
+	}
+}
+
+func TestLoadCertStore(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+
+	s, err := loadCertStore(certFile, keyFile, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf := s.conf.Certificates[0].Leaf
+	if !leaf.IsCA || leaf.CheckSignatureFrom(leaf) != nil {
+		t.Errorf("generated certificate is not self-signed")
+	}
+	for _, host := range []string{"localhost", "127.0.0.1", "::1"} {
+		if err := leaf.VerifyHostname(host); err != nil {
+			t.Errorf("generated certificate: %s", err)
+		}
+	}
+	if fi, err := os.Stat(keyFile); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("key file %v, %v, want mode 0600", fi.Mode(), err)
+	}
+
+	// Existing files are loaded, not generated again.
+	again, err := loadCertStore(certFile, keyFile, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spkiPin(again.conf.Certificates[0].Leaf) != spkiPin(leaf) {
+		t.Errorf("certificate generated again over existing files")
+	}
+
+	tests := []struct {
+		name              string
+		certFile, keyFile string
+		caFile, crlFile   string
+	}{
+		{"no key file name", certFile, "", "", ""},
+		{"no cert file name", "", keyFile, "", ""},
+		{"missing key", certFile, filepath.Join(dir, "missing.pem"), "", ""},
+		{"mismatched files", keyFile, certFile, "", ""},
+		{"crl without ca", certFile, keyFile, "", filepath.Join(dir, "ca.crl")},
+		{"missing ca", certFile, keyFile, filepath.Join(dir, "missing.pem"), ""},
+	}
+	for _, tt := range tests {
+		if _, err := loadCertStore(tt.certFile, tt.keyFile, tt.caFile, tt.crlFile); err == nil {
+			t.Errorf("%s: loaded, want error", tt.name)
+		}
+	}
+}
+
+func TestClientTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	s, err := loadCertStore(certFile, filepath.Join(dir, "key.pem"), "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pin := spkiPin(s.conf.Certificates[0].Leaf)
+	sum := sha256.Sum256([]byte("other key"))
+	other := "sha256/" + base64.StdEncoding.EncodeToString(sum[:])
+
+	tests := []struct {
+		name   string
+		caFile string
+		pins   []string
+		err    bool // building the config
+		ok     bool // handshaking
+	}{
+		{"pin only", "", []string{pin}, false, true},
+		{"pin without prefix", "", []string{pin[len("sha256/"):]}, false, true},
+		{"pin among others", "", []string{other, pin}, false, true},
+		{"pin mismatch", "", []string{other}, false, false},
+		{"ca", certFile, nil, false, true},
+		{"ca and pin", certFile, []string{pin}, false, true},
+		{"ca and pin mismatch", certFile, []string{other}, false, false},
+		{"system roots", "", nil, false, false},
+		{"invalid pin", "", []string{"sha256/abc"}, true, false},
+		{"missing ca", filepath.Join(dir, "missing.pem"), nil, true, false},
+	}
+	for _, tt := range tests {
+		conf, err := clientTLSConfig(tt.caFile, tt.pins, "", "")
+		if (err != nil) != tt.err {
+			t.Errorf("%s: clientTLSConfig error %v, want error %v", tt.name, err, tt.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		conf.ServerName = "localhost"
+
+		c, sc := net.Pipe()
+		go func() {
+			tls.Server(sc, s.tlsConfig()).Handshake()
+			sc.Close()
+		}()
+		err = tls.Client(c, conf).Handshake()
+		c.Close()
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: handshake error %v, want success %v", tt.name, err, tt.ok)
+		}
+	}
+	if _, err := clientTLSConfig("", []string{pin}, certFile, ""); err == nil {
+		t.Errorf("client certificate without a key: built, want error")
+	}
+}
@@ -0,0 +1,586 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	dnsTimeout     = 5 * time.Second
+	dnsIdleTimeout = 60 * time.Second
+	dnsNegativeTTL = 60
+	dnsCacheSize   = 4096
+)
+
+var (
+	errDNSTimeout = errors.New("dns query timeout")
+	errDNSMessage = errors.New("invalid dns message")
+)
+
+// DNS messages are carried on the tunnel as on TCP, each one prefixed by
+// its length. https://tools.ietf.org/html/rfc1035#section-4.2.2
+// +-----+----------+
+// | LEN |   MSG    |
+// +-----+----------+
+// |  2  | Variable |
+// +-----+----------+
+
+func writeDNSMsg(w io.Writer, msg []byte) error {
+	b := make([]byte, 2, 2+len(msg))
+	binary.BigEndian.PutUint16(b, uint16(len(msg)))
+	_, err := w.Write(append(b, msg...))
+	return err
+}
+
+func readDNSMsg(r io.Reader) ([]byte, error) {
+	var l [2]byte
+	if _, err := io.ReadFull(r, l[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(l[:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// defaultResolver returns the first nameserver of /etc/resolv.conf which is
+// not a loopback address, since that may well be us.
+func defaultResolver() string {
+	if f, err := os.Open("/etc/resolv.conf"); err == nil {
+		defer f.Close()
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			fs := strings.Fields(sc.Text())
+			if len(fs) < 2 || fs[0] != "nameserver" {
+				continue
+			}
+			if ip := net.ParseIP(fs[1]); ip != nil && !ip.IsLoopback() {
+				return net.JoinHostPort(fs[1], "53")
+			}
+		}
+	}
+	return "8.8.8.8:53"
+}
+
+// resolverAddr adds the default port to a resolver given without one.
+func resolverAddr(resolver string) string {
+	if resolver == "" {
+		return defaultResolver()
+	}
+	if _, _, err := net.SplitHostPort(resolver); err != nil {
+		return net.JoinHostPort(resolver, "53")
+	}
+	return resolver
+}
+
+// exchangeDNS sends query to resolver over UDP, retrying over TCP when the
+// response is truncated.
+func exchangeDNS(resolver string, query []byte) ([]byte, error) {
+	if len(query) < 12 {
+		return nil, errDNSMessage
+	}
+	uc, err := net.DialTimeout("udp", resolver, dnsTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer uc.Close()
+	uc.SetDeadline(time.Now().Add(dnsTimeout))
+	if _, err := uc.Write(query); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, udpBufSize)
+	for {
+		n, err := uc.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		if n < 12 || buf[0] != query[0] || buf[1] != query[1] {
+			continue // not ours
+		}
+		if buf[2]&0x02 == 0 { // not truncated
+			return append([]byte(nil), buf[:n]...), nil
+		}
+		break
+	}
+
+	tc, err := net.DialTimeout("tcp", resolver, dnsTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer tc.Close()
+	tc.SetDeadline(time.Now().Add(dnsTimeout))
+	if err := writeDNSMsg(tc, query); err != nil {
+		return nil, err
+	}
+	return readDNSMsg(tc)
+}
+
+// dnsServer answers DNS queries on a local address, resolving each name
+// the way its connections would be routed.
+type dnsServer struct {
+	srv      *SocksSrv
+	mode     rune
+	udp      net.PacketConn
+	tcp      net.Listener
+	resolver string
+	cache    *dnsCache
+	tunnel   *dnsTunnel
+}
+
+func listenDNS(srv *SocksSrv, spec, resolver string) (*dnsServer, error) {
+	network, address, mode, err := parseListen(spec)
+	if err != nil {
+		return nil, err
+	}
+	if network != "tcp" {
+		return nil, fmt.Errorf("Invalid DNS address %s", spec)
+	}
+	uc, err := net.ListenPacket("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		uc.Close()
+		return nil, err
+	}
+	return &dnsServer{
+		srv:      srv,
+		mode:     mode,
+		udp:      uc,
+		tcp:      l,
+		resolver: resolverAddr(resolver),
+		cache:    newDNSCache(),
+		tunnel:   &dnsTunnel{srv: srv, waiting: make(map[uint16]chan []byte)},
+	}, nil
+}
+
+func (d *dnsServer) Close() error {
+	d.tcp.Close()
+	d.tunnel.close()
+	return d.udp.Close()
+}
+
+// serve answers queries on both sockets until they are closed.
+func (d *dnsServer) serve() {
+	log.Infof("DNS start on: %s, resolver %s", d.udp.LocalAddr(), d.resolver)
+	go d.serveTCP()
+
+	buf := make([]byte, udpBufSize)
+	for {
+		n, from, err := d.udp.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if !d.srv.acl.allowed(from) {
+			continue
+		}
+		query := append([]byte(nil), buf[:n]...)
+		go func() {
+			if resp := d.resolve(query); resp != nil {
+				d.udp.WriteTo(resp, from)
+			}
+		}()
+	}
+}
+
+func (d *dnsServer) serveTCP() {
+	for {
+		c, err := d.tcp.Accept()
+		if err != nil {
+			return
+		}
+		if !d.srv.acl.allowed(c.RemoteAddr()) {
+			c.Close()
+			continue
+		}
+		go func() {
+			defer c.Close()
+			for {
+				c.SetDeadline(time.Now().Add(dnsIdleTimeout))
+				query, err := readDNSMsg(c)
+				if err != nil {
+					return
+				}
+				resp := d.resolve(query)
+				if resp == nil {
+					return
+				}
+				if err := writeDNSMsg(c, resp); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+// resolve answers query from the cache, or from the resolver its name
+// routes to. It returns nil for queries not worth an answer.
+func (d *dnsServer) resolve(query []byte) []byte {
+	var p dnsmessage.Parser
+	h, err := p.Start(query)
+	if err != nil || h.Response {
+		return nil
+	}
+	q, err := p.Question()
+	if err != nil {
+		return nil
+	}
+
+	name := strings.TrimSuffix(q.Name.String(), ".")
+	addr, err := NewAddr("udp", net.JoinHostPort(name, "53"))
+	if err != nil {
+		return dnsError(h, q, dnsmessage.RCodeFormatError)
+	}
+	m := d.srv.away.ResloveModeWith(d.mode, addr)
+	if m == ModeDrop {
+		log.Infof("DNS %s %s dropped", q.Type, name)
+		return dnsError(h, q, dnsmessage.RCodeNameError)
+	}
+	if d.srv.fake != nil && m != ModePass && q.Class == dnsmessage.ClassINET &&
+		(q.Type == dnsmessage.TypeA || q.Type == dnsmessage.TypeAAAA) {
+		return d.fakeAnswer(h, q, name)
+	}
+
+	key := cacheKey(q)
+	if resp := d.cache.get(key, h.ID); resp != nil {
+		return resp
+	}
+
+	var resp []byte
+	switch m {
+	case ModeAway:
+		resp, err = d.tunnel.exchange(query)
+	default:
+		resp, err = exchangeDNS(d.resolver, query)
+	}
+	if err != nil {
+		log.Warnf("DNS %s %s failure: %s", q.Type, name, err)
+		return dnsError(h, q, dnsmessage.RCodeServerFailure)
+	}
+	d.cache.put(key, resp)
+	return resp
+}
+
+// fakeAnswer answers an A query with the fake IP of name, and an AAAA one
+// with no address so clients stick to the fake one.
+func (d *dnsServer) fakeAnswer(h dnsmessage.Header, q dnsmessage.Question, name string) []byte {
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:                 h.ID,
+			Response:           true,
+			OpCode:             h.OpCode,
+			RecursionDesired:   h.RecursionDesired,
+			RecursionAvailable: true,
+		},
+		Questions: []dnsmessage.Question{q},
+	}
+	if q.Type == dnsmessage.TypeA {
+		var a dnsmessage.AResource
+		copy(a.A[:], d.srv.fake.alloc(name))
+		msg.Answers = []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: q.Class, TTL: fakeTTL},
+			Body:   &a,
+		}}
+	}
+	b, err := msg.Pack()
+	if err != nil {
+		return nil
+	}
+	return b
+}
+
+// dnsError builds a response to the query h and q carrying rcode.
+func dnsError(h dnsmessage.Header, q dnsmessage.Question, rcode dnsmessage.RCode) []byte {
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:                 h.ID,
+			Response:           true,
+			OpCode:             h.OpCode,
+			RecursionDesired:   h.RecursionDesired,
+			RecursionAvailable: true,
+			RCode:              rcode,
+		},
+		Questions: []dnsmessage.Question{q},
+	}
+	b, err := msg.Pack()
+	if err != nil {
+		return nil
+	}
+	return b
+}
+
+func cacheKey(q dnsmessage.Question) string {
+	return fmt.Sprintf("%s|%d|%d", strings.ToLower(q.Name.String()), q.Type, q.Class)
+}
+
+type dnsEntry struct {
+	msg     dnsmessage.Message
+	stored  time.Time
+	expires time.Time
+}
+
+// dnsCache keeps responses until their smallest TTL runs out.
+type dnsCache struct {
+	mu      sync.Mutex
+	entries map[string]*dnsEntry
+}
+
+func newDNSCache() *dnsCache {
+	return &dnsCache{entries: make(map[string]*dnsEntry)}
+}
+
+// get returns the cached response for key with id and its TTLs lowered by
+// the time spent in the cache.
+func (c *dnsCache) get(key string, id uint16) []byte {
+	now := time.Now()
+	c.mu.Lock()
+	e := c.entries[key]
+	if e != nil && !now.Before(e.expires) {
+		delete(c.entries, key)
+		e = nil
+	}
+	c.mu.Unlock()
+	if e == nil {
+		return nil
+	}
+
+	msg := e.msg
+	msg.ID = id
+	age := uint32(now.Sub(e.stored) / time.Second)
+	sections := make([][]dnsmessage.Resource, 3)
+	for i, rs := range [][]dnsmessage.Resource{msg.Answers, msg.Authorities, msg.Additionals} {
+		sections[i] = make([]dnsmessage.Resource, len(rs))
+		for j, r := range rs {
+			if r.Header.Type != dnsmessage.TypeOPT {
+				r.Header.TTL -= age
+			}
+			sections[i][j] = r
+		}
+	}
+	msg.Answers, msg.Authorities, msg.Additionals = sections[0], sections[1], sections[2]
+
+	b, err := msg.Pack()
+	if err != nil {
+		return nil
+	}
+	return b
+}
+
+// put caches resp for the smallest TTL of its records. Failures other than
+// NXDOMAIN are not cached.
+func (c *dnsCache) put(key string, resp []byte) {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(resp); err != nil {
+		return
+	}
+	if msg.RCode != dnsmessage.RCodeSuccess && msg.RCode != dnsmessage.RCodeNameError {
+		return
+	}
+	if msg.Truncated {
+		return
+	}
+
+	ttl := uint32(0)
+	found := false
+	for _, rs := range [][]dnsmessage.Resource{msg.Answers, msg.Authorities, msg.Additionals} {
+		for _, r := range rs {
+			if r.Header.Type == dnsmessage.TypeOPT {
+				continue
+			}
+			if !found || r.Header.TTL < ttl {
+				ttl = r.Header.TTL
+				found = true
+			}
+		}
+	}
+	if !found {
+		ttl = dnsNegativeTTL
+	}
+	if ttl == 0 {
+		return
+	}
+
+	now := time.Now()
+	e := &dnsEntry{msg: msg, stored: now, expires: now.Add(time.Duration(ttl) * time.Second)}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= dnsCacheSize {
+		for k, e := range c.entries {
+			if !now.Before(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		for k := range c.entries { // still full, drop any
+			if len(c.entries) < dnsCacheSize {
+				break
+			}
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = e
+}
+
+// dnsTunnel multiplexes queries on a single tunnel to the remote, renaming
+// their IDs so queries from different clients cannot clash.
+type dnsTunnel struct {
+	srv *SocksSrv
+
+	wmu sync.Mutex // serializes queries, each one a single write
+
+	mu      sync.Mutex
+	conn    net.Conn
+	idle    *time.Timer
+	next    uint16
+	waiting map[uint16]chan []byte
+	closed  bool
+}
+
+func (t *dnsTunnel) exchange(query []byte) ([]byte, error) {
+	ch := make(chan []byte, 1)
+
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return nil, io.ErrClosedPipe
+	}
+	if t.conn == nil {
+		conn, _, err := t.srv.dialTunnel(cmdDNS, zeroAddr)
+		if err != nil {
+			t.mu.Unlock()
+			return nil, err
+		}
+		t.conn = conn
+		t.idle = time.AfterFunc(dnsIdleTimeout, func() { conn.Close() })
+		go t.read(conn)
+	}
+	t.idle.Reset(dnsIdleTimeout)
+	conn := t.conn
+
+	id := t.next
+	for {
+		id++
+		if _, ok := t.waiting[id]; !ok {
+			break
+		}
+	}
+	t.next = id
+	t.waiting[id] = ch
+	t.mu.Unlock()
+
+	defer func() {
+		t.mu.Lock()
+		delete(t.waiting, id)
+		t.mu.Unlock()
+	}()
+
+	msg := append([]byte(nil), query...)
+	binary.BigEndian.PutUint16(msg, id)
+	t.wmu.Lock()
+	err := writeDNSMsg(conn, msg)
+	t.wmu.Unlock()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	select {
+	case resp := <-ch:
+		if resp == nil {
+			return nil, io.ErrUnexpectedEOF
+		}
+		copy(resp, query[:2])
+		return resp, nil
+	case <-time.After(dnsTimeout):
+		return nil, errDNSTimeout
+	}
+}
+
+func (t *dnsTunnel) read(conn net.Conn) {
+	defer func() {
+		conn.Close()
+		t.mu.Lock()
+		if t.conn == conn {
+			t.conn = nil
+			t.idle.Stop()
+		}
+		for id, ch := range t.waiting {
+			select {
+			case ch <- nil:
+			default:
+			}
+			delete(t.waiting, id)
+		}
+		t.mu.Unlock()
+	}()
+
+	for {
+		resp, err := readDNSMsg(conn)
+		if err != nil {
+			return
+		}
+		if len(resp) < 12 {
+			continue
+		}
+		t.mu.Lock()
+		ch, ok := t.waiting[binary.BigEndian.Uint16(resp)]
+		t.mu.Unlock()
+		if ok {
+			select {
+			case ch <- resp:
+			default:
+			}
+		}
+	}
+}
+
+func (t *dnsTunnel) close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.closed = true
+	if t.conn != nil {
+		t.conn.Close()
+	}
+}
+
+// relayDNS serves a DNS tunnel on the remote, answering each query with
+// resolver.
+func relayDNS(wss net.Conn, resolver string) {
+	if _, err := reply(wss, repSucceeded, nil); err != nil {
+		return
+	}
+
+	var mu sync.Mutex
+	var n int
+	for {
+		query, err := readDNSMsg(wss)
+		if err != nil {
+			break
+		}
+		n++
+		go func() {
+			resp, err := exchangeDNS(resolver, query)
+			if err != nil {
+				log.Warn("DNS exchange failure: ", err)
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			writeDNSMsg(wss, resp)
+		}()
+	}
+	log.Infof("Away DNS: %s ~ %s <%d>", clientName(wss), resolver, n)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func testDNSResponse(t *testing.T, rcode dnsmessage.RCode, truncated bool, answers, authorities []uint32, edns bool) []byte {
+	name := dnsmessage.MustNewName("example.com.")
+	msg := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: 1, Response: true, RCode: rcode, Truncated: truncated},
+		Questions: []dnsmessage.Question{{Name: name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}},
+	}
+	for _, ttl := range answers {
+		msg.Answers = append(msg.Answers, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: ttl},
+			Body:   &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}},
+		})
+	}
+	for _, ttl := range authorities {
+		msg.Authorities = append(msg.Authorities, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: name, Type: dnsmessage.TypeSOA, Class: dnsmessage.ClassINET, TTL: ttl},
+			Body:   &dnsmessage.SOAResource{NS: name, MBox: name, MinTTL: ttl},
+		})
+	}
+	if edns {
+		var opt dnsmessage.ResourceHeader
+		if err := opt.SetEDNS0(1232, dnsmessage.RCodeSuccess, false); err != nil {
+			t.Fatal(err)
+		}
+		msg.Additionals = append(msg.Additionals, dnsmessage.Resource{Header: opt, Body: &dnsmessage.OPTResource{}})
+	}
+	b, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestDNSCachePut(t *testing.T) {
+	tests := []struct {
+		name        string
+		rcode       dnsmessage.RCode
+		truncated   bool
+		answers     []uint32
+		authorities []uint32
+		edns        bool
+		ttl         int // 0 when not cached
+	}{
+		{"single", dnsmessage.RCodeSuccess, false, []uint32{300}, nil, false, 300},
+		{"smallest", dnsmessage.RCodeSuccess, false, []uint32{300, 60}, []uint32{900}, false, 60},
+		{"opt ignored", dnsmessage.RCodeSuccess, false, []uint32{300}, nil, true, 300},
+		{"zero ttl", dnsmessage.RCodeSuccess, false, []uint32{300, 0}, nil, false, 0},
+		{"no records", dnsmessage.RCodeSuccess, false, nil, nil, true, dnsNegativeTTL},
+		{"nxdomain", dnsmessage.RCodeNameError, false, nil, nil, false, dnsNegativeTTL},
+		{"nxdomain soa", dnsmessage.RCodeNameError, false, nil, []uint32{900}, false, 900},
+		{"servfail", dnsmessage.RCodeServerFailure, false, []uint32{300}, nil, false, 0},
+		{"refused", dnsmessage.RCodeRefused, false, nil, nil, false, 0},
+		{"truncated", dnsmessage.RCodeSuccess, true, []uint32{300}, nil, false, 0},
+	}
+	for _, tt := range tests {
+		c := newDNSCache()
+		c.put("k", testDNSResponse(t, tt.rcode, tt.truncated, tt.answers, tt.authorities, tt.edns))
+		e := c.entries["k"]
+		if tt.ttl == 0 {
+			if e != nil {
+				t.Errorf("%s: cached for %s, want not cached", tt.name, e.expires.Sub(e.stored))
+			}
+			continue
+		}
+		if e == nil {
+			t.Errorf("%s: not cached, want cached for %ds", tt.name, tt.ttl)
+		} else if got := e.expires.Sub(e.stored); got != time.Duration(tt.ttl)*time.Second {
+			t.Errorf("%s: cached for %s, want %ds", tt.name, got, tt.ttl)
+		}
+	}
+}
+
+func TestDNSCacheGet(t *testing.T) {
+	c := newDNSCache()
+	c.put("k", testDNSResponse(t, dnsmessage.RCodeSuccess, false, []uint32{300, 120}, []uint32{600}, true))
+	if c.get("other", 7) != nil {
+		t.Fatal("get of a missing key answered")
+	}
+
+	tests := []struct {
+		age  time.Duration
+		ttls []uint32 // answers then authorities, nil when expired
+	}{
+		{0, []uint32{300, 120, 600}},
+		{10 * time.Second, []uint32{290, 110, 590}},
+		{119*time.Second + 500*time.Millisecond, []uint32{181, 1, 481}},
+		{120 * time.Second, nil},
+	}
+	e := c.entries["k"]
+	stored, expires := e.stored, e.expires
+	for _, tt := range tests {
+		c.mu.Lock()
+		e.stored, e.expires = stored.Add(-tt.age), expires.Add(-tt.age)
+		c.mu.Unlock()
+
+		b := c.get("k", 42)
+		if tt.ttls == nil {
+			if b != nil {
+				t.Errorf("age %s: answered after expiry", tt.age)
+			}
+			if _, ok := c.entries["k"]; ok {
+				t.Errorf("age %s: expired entry kept", tt.age)
+			}
+			continue
+		}
+		var msg dnsmessage.Message
+		if err := msg.Unpack(b); err != nil {
+			t.Fatalf("age %s: %v", tt.age, err)
+		}
+		if msg.ID != 42 {
+			t.Errorf("age %s: ID %d, want 42", tt.age, msg.ID)
+		}
+		var ttls []uint32
+		for _, r := range append(msg.Answers, msg.Authorities...) {
+			ttls = append(ttls, r.Header.TTL)
+		}
+		if len(ttls) != len(tt.ttls) {
+			t.Fatalf("age %s: TTLs %v, want %v", tt.age, ttls, tt.ttls)
+		}
+		for i := range ttls {
+			if ttls[i] != tt.ttls[i] {
+				t.Errorf("age %s: TTLs %v, want %v", tt.age, ttls, tt.ttls)
+				break
+			}
+		}
+		if len(msg.Additionals) != 1 || msg.Additionals[0].Header.Type != dnsmessage.TypeOPT {
+			t.Errorf("age %s: OPT record lost", tt.age)
+		} else if opt := msg.Additionals[0].Header; opt.TTL != 0 {
+			t.Errorf("age %s: OPT TTL changed to %d", tt.age, opt.TTL)
+		}
+	}
+}
+
+func TestDNSCacheSize(t *testing.T) {
+	c := newDNSCache()
+	resp := testDNSResponse(t, dnsmessage.RCodeSuccess, false, []uint32{300}, nil, false)
+	for i := 0; i < dnsCacheSize+10; i++ {
+		c.put(strconv.Itoa(i), resp)
+	}
+	if n := len(c.entries); n > dnsCacheSize {
+		t.Errorf("cache holds %d entries, want at most %d", n, dnsCacheSize)
+	}
+}
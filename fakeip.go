@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	fakeTTL    = 60
+	fakeExpiry = 10 * time.Minute
+)
+
+type fakeEntry struct {
+	name string
+	used time.Time
+}
+
+// fakeIPs hands out addresses of a reserved range for names, so connections
+// to those addresses can be routed by name again. Entries unused for
+// fakeExpiry may be handed out anew.
+type fakeIPs struct {
+	base uint32
+	size uint32
+
+	mu     sync.Mutex
+	next   uint32
+	byName map[string]uint32
+	byIP   map[uint32]*fakeEntry
+}
+
+// newFakeIPs parses an IPv4 range given as CIDR, eg: "198.18.0.0/15".
+func newFakeIPs(cidr string) (*fakeIPs, error) {
+	_, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid fake IP range %s, %s", cidr, err)
+	}
+	ip := ipnet.IP.To4()
+	ones, bits := ipnet.Mask.Size()
+	if ip == nil || bits != 32 || bits-ones < 2 {
+		return nil, fmt.Errorf("Invalid fake IP range %s, want an IPv4 range of 4 addresses at least", cidr)
+	}
+	return &fakeIPs{
+		base:   binary.BigEndian.Uint32(ip),
+		size:   1<<uint(bits-ones) - 2, // without network and broadcast
+		byName: make(map[string]uint32),
+		byIP:   make(map[uint32]*fakeEntry),
+	}, nil
+}
+
+// alloc returns the address of name, handing one out if needed.
+func (f *fakeIPs) alloc(name string) net.IP {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	now := time.Now()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if n, ok := f.byName[name]; ok {
+		f.byIP[n].used = now
+		return f.ip(n)
+	}
+
+	// Take the first free or expired address, or the next one when all
+	// are in use.
+	n := f.next
+	for i := uint32(0); i < f.size; i++ {
+		e, ok := f.byIP[(f.next+i)%f.size]
+		if !ok || now.Sub(e.used) > fakeExpiry {
+			n = (f.next + i) % f.size
+			break
+		}
+	}
+	f.next = (n + 1) % f.size
+
+	if e, ok := f.byIP[n]; ok {
+		delete(f.byName, e.name)
+	}
+	f.byIP[n] = &fakeEntry{name: name, used: now}
+	f.byName[name] = n
+	return f.ip(n)
+}
+
+// lookup returns the name ip was handed out for.
+func (f *fakeIPs) lookup(ip net.IP) (string, bool) {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return "", false
+	}
+	n := binary.BigEndian.Uint32(ip4) - f.base - 1
+	if n >= f.size {
+		return "", false
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	e, ok := f.byIP[n]
+	if !ok {
+		return "", false
+	}
+	e.used = time.Now()
+	return e.name, true
+}
+
+func (f *fakeIPs) ip(n uint32) net.IP {
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, f.base+1+n)
+	return ip
+}
+
+// realAddr turns addr back into the name its fake IP was handed out for.
+func (s *SocksSrv) realAddr(addr *Addr) *Addr {
+	if s.fake == nil || addr.addr[0] != atypIPv4 {
+		return addr
+	}
+	name, ok := s.fake.lookup(net.IP(addr.addr[1:5]))
+	if !ok {
+		return addr
+	}
+	a, err := NewAddr(addr.network, net.JoinHostPort(name, strconv.Itoa(addr.Port())))
+	if err != nil {
+		return addr
+	}
+	return a
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestNewFakeIPs(t *testing.T) {
+	tests := []struct {
+		cidr string
+		size uint32
+		err  bool
+	}{
+		{"198.18.0.0/15", 1<<17 - 2, false},
+		{"198.18.0.0/30", 2, false},
+		{"198.18.0.7/24", 254, false},
+		{"198.18.0.0/31", 0, true},
+		{"198.18.0.0/32", 0, true},
+		{"fc00::/64", 0, true},
+		{"198.18.0.0", 0, true},
+	}
+	for _, tt := range tests {
+		f, err := newFakeIPs(tt.cidr)
+		if (err != nil) != tt.err {
+			t.Errorf("newFakeIPs(%s) error %v, want error %v", tt.cidr, err, tt.err)
+			continue
+		}
+		if err == nil && f.size != tt.size {
+			t.Errorf("newFakeIPs(%s) size %d, want %d", tt.cidr, f.size, tt.size)
+		}
+	}
+}
+
+func TestFakeIPsAlloc(t *testing.T) {
+	f, err := newFakeIPs("198.18.0.0/29")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		ip   string
+	}{
+		{"example.com", "198.18.0.1"},
+		{"example.org.", "198.18.0.2"},
+		{"Example.COM.", "198.18.0.1"},
+		{"www.example.com", "198.18.0.3"},
+		{"example.org", "198.18.0.2"},
+	}
+	for _, tt := range tests {
+		if ip := f.alloc(tt.name); ip.String() != tt.ip {
+			t.Errorf("alloc(%s) = %s, want %s", tt.name, ip, tt.ip)
+		}
+	}
+
+	lookups := []struct {
+		ip   net.IP
+		name string
+		ok   bool
+	}{
+		{net.ParseIP("198.18.0.1"), "example.com", true},
+		{net.IPv4(198, 18, 0, 3), "www.example.com", true},
+		{net.ParseIP("198.18.0.4"), "", false},
+		{net.ParseIP("198.18.0.0"), "", false},
+		{net.ParseIP("198.18.0.7"), "", false},
+		{net.ParseIP("198.18.0.9"), "", false},
+		{net.ParseIP("192.0.2.1"), "", false},
+		{net.ParseIP("2001:db8::1"), "", false},
+	}
+	for _, tt := range lookups {
+		if name, ok := f.lookup(tt.ip); name != tt.name || ok != tt.ok {
+			t.Errorf("lookup(%s) = %q %v, want %q %v", tt.ip, name, ok, tt.name, tt.ok)
+		}
+	}
+}
+
+func TestFakeIPsExpiry(t *testing.T) {
+	f, err := newFakeIPs("198.18.0.0/30")
+	if err != nil {
+		t.Fatal(err)
+	}
+	age := func(ip string) {
+		f.mu.Lock()
+		f.byIP[fakeIndex(t, f, ip)].used = time.Now().Add(-fakeExpiry - time.Second)
+		f.mu.Unlock()
+	}
+
+	steps := []struct {
+		alloc string
+		aged  string // address aged past fakeExpiry before alloc
+		ip    string
+		gone  string // name no longer handed out
+	}{
+		{"a.com", "", "198.18.0.1", ""},
+		{"b.com", "", "198.18.0.2", ""},
+		{"c.com", "", "198.18.0.1", "a.com"}, // all in use, the next one is taken
+		{"d.com", "198.18.0.1", "198.18.0.1", "c.com"},
+		{"e.com", "198.18.0.1", "198.18.0.1", "d.com"}, // expired beats the next one
+		{"b.com", "198.18.0.2", "198.18.0.2", ""},      // expired but still there
+	}
+	for _, st := range steps {
+		if st.aged != "" {
+			age(st.aged)
+		}
+		if ip := f.alloc(st.alloc); ip.String() != st.ip {
+			t.Errorf("alloc(%s) = %s, want %s", st.alloc, ip, st.ip)
+		}
+		if name, _ := f.lookup(net.ParseIP(st.ip)); name != st.alloc {
+			t.Errorf("lookup(%s) = %s, want %s", st.ip, name, st.alloc)
+		}
+		if st.gone != "" {
+			f.mu.Lock()
+			_, ok := f.byName[st.gone]
+			f.mu.Unlock()
+			if ok {
+				t.Errorf("alloc(%s) kept %s", st.alloc, st.gone)
+			}
+		}
+	}
+}
+
+func fakeIndex(t *testing.T, f *fakeIPs, ip string) uint32 {
+	for n := uint32(0); n < f.size; n++ {
+		if f.ip(n).String() == ip {
+			return n
+		}
+	}
+	t.Fatalf("%s out of the fake range", ip)
+	return 0
+}
+
+func TestRealAddr(t *testing.T) {
+	f, err := newFakeIPs("198.18.0.0/15")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.alloc("example.com")
+	s := &SocksSrv{fake: f}
+
+	tests := []struct {
+		addr, want string
+	}{
+		{"198.18.0.1:443", "example.com:443"},
+		{"198.18.0.2:443", "198.18.0.2:443"},
+		{"192.0.2.1:80", "192.0.2.1:80"},
+		{"example.org:80", "example.org:80"},
+		{"[2001:db8::1]:80", "[2001:db8::1]:80"},
+	}
+	for _, tt := range tests {
+		addr, _ := NewAddr("udp", tt.addr)
+		got := s.realAddr(addr)
+		if got.String() != tt.want || got.Network() != "udp" {
+			t.Errorf("realAddr(%s) = %s %s, want udp %s", tt.addr, got.Network(), got, tt.want)
+		}
+	}
+}
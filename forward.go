@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// forward is a local listener whose connections all go to target, through
+// the remote unless its listen address is prefixed by another mode.
+type forward struct {
+	*listener
+	target *Addr
+}
+
+// listenForward listens for a forward given as "listen=host:port",
+// eg: "127.0.0.1:15432=db.internal:5432".
+func listenForward(spec string) (*forward, error) {
+	i := strings.LastIndex(spec, "=")
+	if i < 0 {
+		return nil, fmt.Errorf("Invalid forward %s, want listen=host:port", spec)
+	}
+	target, err := NewAddr("tcp", spec[i+1:])
+	if err != nil {
+		return nil, fmt.Errorf("Invalid forward %s, %s", spec, err)
+	}
+	l, err := listen(spec[:i])
+	if err != nil {
+		return nil, err
+	}
+	if l.mode == 0 {
+		l.mode = ModeAway
+	}
+	return &forward{listener: l, target: target}, nil
+}
+
+func (s *SocksSrv) serveForward(f *forward) {
+	log.Infof("Forward %s %c %s", f.Addr(), f.mode, f.target.String())
+
+	for {
+		c, err := f.Accept()
+		if err != nil {
+			select {
+			case <-s.stop:
+				return
+			default:
+				log.Warn("Accepting connection failure: ", err)
+				continue
+			}
+		}
+		if !s.acl.allowed(c.RemoteAddr()) {
+			c.Close()
+			continue
+		}
+		ip := connIP(c.RemoteAddr())
+		if err := s.limits.acquire(ip); err != nil {
+			s.limits.reject(c.RemoteAddr(), err)
+			c.Close()
+			continue
+		}
+
+		go func(c net.Conn) {
+			defer func() {
+				c.Close()
+				s.limits.release(ip)
+			}()
+
+			keepAlive(c)
+			s.route(c, f.target, f.mode, nil)
+		}(c)
+	}
+}
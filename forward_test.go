@@ -0,0 +1,38 @@
+package main
+
+import "testing"
+
+func TestListenForward(t *testing.T) {
+	tests := []struct {
+		spec   string
+		mode   rune
+		target string
+		err    bool
+	}{
+		{"127.0.0.1:0=db.internal:5432", ModeAway, "db.internal:5432", false},
+		{"@127.0.0.1:0=10.0.0.1:22", ModePass, "10.0.0.1:22", false},
+		{"*127.0.0.1:0=[::1]:8080", ModeRule, "[::1]:8080", false},
+		{"127.0.0.1:0=a=b:80", 0, "", true},
+		{"127.0.0.1:0", 0, "", true},
+		{"127.0.0.1:0=db.internal", 0, "", true},
+		{"=db.internal:5432", 0, "", true},
+		{"1080=db.internal:5432", 0, "", true},
+	}
+	for _, tt := range tests {
+		f, err := listenForward(tt.spec)
+		if (err != nil) != tt.err {
+			t.Errorf("listenForward(%q) error %v, want error %v", tt.spec, err, tt.err)
+			if err == nil {
+				f.Close()
+			}
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if f.mode != tt.mode || f.target.String() != tt.target {
+			t.Errorf("listenForward(%q) = %q %s, want %q %s", tt.spec, f.mode, f.target.String(), tt.mode, tt.target)
+		}
+		f.Close()
+	}
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// h2Path is where the remote serves tunnels over HTTP/2, each one being a
+// POST whose request and response bodies carry the frames of frameConn.
+const h2Path = "/_h"
+
+const (
+	h2BufSize = 256 * 1024
+	h2Linger  = 30 * time.Second
+)
+
+// h2Transport opens tunnels as requests on HTTP/2 connections it shares,
+// over TLS, or cleartext for h2c.
+type h2Transport struct {
+	url    string
+	host   string
+	header http.Header
+	client *http.Client
+}
+
+// newH2Transport connects to addr, sending host as the authority of the
+// requests along header.
+func newH2Transport(addr, host string, header http.Header, cleartext bool, conf *tls.Config) *h2Transport {
+	t := &http2.Transport{TLSClientConfig: conf}
+	scheme := "https"
+	if cleartext {
+		scheme = "http"
+		t.AllowHTTP = true
+		t.DialTLS = func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+			return net.DialTimeout(network, addr, dialTimeout)
+		}
+	}
+	return &h2Transport{
+		url:    scheme + "://" + addr + h2Path,
+		host:   host,
+		header: header,
+		client: &http.Client{Transport: t},
+	}
+}
+
+func (t *h2Transport) dial() (net.Conn, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	pr, pw := io.Pipe()
+	req, err := http.NewRequest("POST", t.url, pr)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	req.Host = t.host
+	for k, v := range t.header {
+		req.Header[k] = v
+	}
+
+	timer := time.AfterFunc(dialTimeout, cancel)
+	resp, err := t.client.Do(req.WithContext(ctx))
+	if !timer.Stop() && err == nil {
+		resp.Body.Close()
+		err = context.DeadlineExceeded
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		cancel()
+		return nil, fmt.Errorf("Remote answered %s", resp.Status)
+	}
+
+	// Closing lingers until the remote ends the response, as canceling
+	// the request at once would reset the stream.
+	c := newH2Conn(resp.Body, pw, h2Addr(t.url), cancel)
+	c.linger = true
+	return newFrameConn(c, bufio.NewReader(c)), nil
+}
+
+func (t *h2Transport) String() string {
+	return t.url
+}
+
+// h2Handler serves the tunnels of HTTP/2 clients.
+func h2Handler(sec *Security, h *tunnelHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		f, ok := w.(http.Flusher)
+		if r.ProtoMajor != 2 || r.Method != "POST" || !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		f.Flush()
+
+		// Writes go through a pipe so that they can be given up on
+		// deadlines, the response being written until it is closed.
+		pr, pw := io.Pipe()
+		written := make(chan struct{})
+		go func() {
+			defer close(written)
+			buf := make([]byte, 32*1024)
+			for {
+				n, err := pr.Read(buf)
+				if n > 0 {
+					if _, err := w.Write(buf[:n]); err != nil {
+						pr.CloseWithError(err)
+						return
+					}
+					f.Flush()
+				}
+				if err != nil {
+					return
+				}
+			}
+		}()
+
+		remote := r.RemoteAddr
+		if fwd := r.Header.Get("x-forwarded-for"); fwd != "" {
+			remote = fwd
+		}
+		c := newH2Conn(r.Body, pw, h2Addr(remote), func() {})
+		wss := withCertUser(sec.secure(newFrameConn(c, bufio.NewReader(c))), r.TLS)
+
+		var ip net.IP
+		if a, ok := r.Context().Value(http.LocalAddrContextKey).(*net.TCPAddr); ok {
+			ip = a.IP
+		}
+		h.serve(wss, ip, false)
+		wss.Close()
+		<-written
+	}
+}
+
+type h2Addr string
+
+func (a h2Addr) Network() string { return "h2" }
+func (a h2Addr) String() string  { return string(a) }
+
+// h2Conn is a net.Conn reading a body and writing to a pipe. Reads are
+// buffered by a goroutine to honour deadlines, and a write past its
+// deadline breaks the pipe.
+type h2Conn struct {
+	body   io.ReadCloser
+	pw     *io.PipeWriter
+	remote net.Addr
+	cancel func()
+	linger bool // on close, until the body ends
+	done   chan struct{}
+
+	wmu sync.Mutex
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	rbuf   []byte
+	rerr   error
+	closed bool
+	rdl    deadline
+	wdl    time.Time
+}
+
+func newH2Conn(body io.ReadCloser, pw *io.PipeWriter, remote net.Addr, cancel func()) *h2Conn {
+	c := &h2Conn{body: body, pw: pw, remote: remote, cancel: cancel, done: make(chan struct{})}
+	c.cond = sync.NewCond(&c.mu)
+	go c.pump()
+	return c
+}
+
+// pump reads the body until it ends, discarding it once closed.
+func (c *h2Conn) pump() {
+	defer close(c.done)
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := c.body.Read(buf)
+
+		c.mu.Lock()
+		c.rbuf = append(c.rbuf, buf[:n]...)
+		if err != nil {
+			c.rerr = err
+		}
+		c.cond.Broadcast()
+		for len(c.rbuf) >= h2BufSize && !c.closed {
+			c.cond.Wait()
+		}
+		if c.closed {
+			c.rbuf = nil
+		}
+		done := c.rerr != nil
+		c.mu.Unlock()
+		if done {
+			return
+		}
+	}
+}
+
+func (c *h2Conn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for {
+		switch {
+		case c.closed:
+			return 0, io.ErrClosedPipe
+		case len(c.rbuf) > 0:
+			n := copy(b, c.rbuf)
+			c.rbuf = c.rbuf[n:]
+			if len(c.rbuf) == 0 {
+				c.rbuf = nil
+			}
+			c.cond.Broadcast()
+			return n, nil
+		case c.rerr != nil:
+			return 0, c.rerr
+		case c.rdl.exceeded():
+			return 0, os.ErrDeadlineExceeded
+		}
+		c.cond.Wait()
+	}
+}
+
+func (c *h2Conn) Write(b []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	c.mu.Lock()
+	wdl := c.wdl
+	c.mu.Unlock()
+	if !wdl.IsZero() {
+		if !time.Now().Before(wdl) {
+			return 0, os.ErrDeadlineExceeded
+		}
+		t := time.AfterFunc(time.Until(wdl), func() {
+			c.pw.CloseWithError(os.ErrDeadlineExceeded)
+		})
+		defer t.Stop()
+	}
+	n, err := c.pw.Write(b)
+	if err != nil && !wdl.IsZero() && !time.Now().Before(wdl) {
+		err = os.ErrDeadlineExceeded // the pipe only tells it was closed
+	}
+	return n, err
+}
+
+func (c *h2Conn) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	c.cond.Broadcast()
+	c.mu.Unlock()
+
+	c.pw.Close()
+	if !c.linger {
+		c.cancel()
+		return c.body.Close()
+	}
+	go func() {
+		select {
+		case <-c.done:
+		case <-time.After(h2Linger):
+		}
+		c.cancel()
+		c.body.Close()
+	}()
+	return nil
+}
+
+func (c *h2Conn) LocalAddr() net.Addr  { return h2Addr("") }
+func (c *h2Conn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *h2Conn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *h2Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rdl.set(t, c.cond)
+	return nil
+}
+
+func (c *h2Conn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.wdl = t
+	return nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+// h2Pair returns two h2Conns, each reading what the other writes.
+func h2Pair() (*h2Conn, *h2Conn) {
+	ar, aw := io.Pipe()
+	br, bw := io.Pipe()
+	return newH2Conn(br, aw, h2Addr("a"), func() {}), newH2Conn(ar, bw, h2Addr("b"), func() {})
+}
+
+func TestH2ConnRoundTrip(t *testing.T) {
+	a, b := h2Pair()
+	defer a.Close()
+	defer b.Close()
+
+	for _, n := range []int{1, 1000, h2BufSize + 1000} {
+		data := bytes.Repeat([]byte{byte(n)}, n)
+		go func() {
+			if _, err := a.Write(data); err != nil {
+				t.Error(err)
+			}
+		}()
+		got := make([]byte, n)
+		if _, err := io.ReadFull(b, got); err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("read %d bytes: %v, data equal %v", n, err, bytes.Equal(got, data))
+		}
+	}
+
+	// The peer reads to the end once a side closes.
+	a.Close()
+	if _, err := b.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Read after peer close: %v, want EOF", err)
+	}
+	if _, err := a.Read(make([]byte, 1)); err != io.ErrClosedPipe {
+		t.Errorf("Read after close: %v, want %v", err, io.ErrClosedPipe)
+	}
+}
+
+func TestH2ConnDeadlines(t *testing.T) {
+	tests := []struct {
+		name  string
+		write bool
+		after time.Duration
+	}{
+		{"read past", false, -time.Second},
+		{"read blocked", false, 20 * time.Millisecond},
+		{"write past", true, -time.Second},
+		{"write blocked", true, 20 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		a, b := h2Pair()
+		var err error
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			if tt.write {
+				a.SetWriteDeadline(time.Now().Add(tt.after))
+				_, err = a.Write(make([]byte, 2*h2BufSize)) // more than b buffers unread
+			} else {
+				a.SetReadDeadline(time.Now().Add(tt.after))
+				_, err = a.Read(make([]byte, 1))
+			}
+		}()
+		select {
+		case <-done:
+			if err != os.ErrDeadlineExceeded {
+				t.Errorf("%s: %v, want %v", tt.name, err, os.ErrDeadlineExceeded)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("%s: deadline not honoured", tt.name)
+		}
+		a.Close()
+		b.Close()
+	}
+
+	// A read deadline pushed back lets a late write through.
+	a, b := h2Pair()
+	defer a.Close()
+	defer b.Close()
+	a.SetReadDeadline(time.Now().Add(-time.Second))
+	a.SetReadDeadline(time.Time{})
+	go b.Write([]byte("x"))
+	if _, err := a.Read(make([]byte, 1)); err != nil {
+		t.Errorf("Read after clearing the deadline: %v", err)
+	}
+}
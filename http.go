@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// serveHTTP acts as an HTTP proxy on conn. CONNECT requests are tunneled
+// through route, absolute-URI requests are forwarded one by one so that a
+// kept alive connection may reach different hosts.
+func (s *SocksSrv) serveHTTP(conn *bufConn, mode rune) {
+	var client net.Conn = conn
+	var uc net.Conn
+	var ur *bufio.Reader
+	var uaddr string
+	defer func() {
+		if uc != nil {
+			uc.Close()
+		}
+	}()
+
+	for {
+		conn.SetDeadline(time.Now().Add(s.handshake))
+		req, err := http.ReadRequest(conn.r)
+		if err != nil {
+			return
+		}
+		conn.SetDeadline(time.Time{})
+
+		if req.URL.Host == "" && req.URL.Path == pacPath {
+			if err := s.servePAC(conn, req, mode); err != nil || req.Close {
+				return
+			}
+			continue
+		}
+		if req.URL.Host == "" && req.URL.Path == statusPath {
+			if err := s.serveStatus(conn, req); err != nil || req.Close {
+				return
+			}
+			continue
+		}
+
+		umode := mode
+		if s.users != nil {
+			user, pass, ok := proxyAuth(req)
+			if !ok || !checkUser(s.users, user, pass) {
+				log.Warnf("Auth %s@%s failure: %s", user, conn.RemoteAddr().String(), errAuthFailed)
+				io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n"+
+					"Proxy-Authenticate: Basic realm=\"Away\"\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+				return
+			}
+			client = &userConn{conn, user}
+			umode = userMode(s.users, user, mode)
+		}
+
+		if req.Method == http.MethodConnect {
+			addr, err := NewAddr("tcp", req.Host)
+			if err != nil {
+				httpError(conn, http.StatusBadRequest)
+				return
+			}
+			addr = s.realAddr(addr)
+			s.route(client, addr, s.away.ResloveModeWith(umode, addr), func(_ *Addr, err error) error {
+				switch err {
+				case nil:
+					_, e := io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+					return e
+				case errDropped:
+					httpError(conn, http.StatusForbidden)
+				default:
+					httpError(conn, http.StatusBadGateway)
+				}
+				return nil
+			})
+			return
+		}
+
+		if req.URL.Scheme != "http" || req.URL.Host == "" {
+			httpError(conn, http.StatusBadRequest)
+			return
+		}
+		hostport := req.URL.Host
+		if req.URL.Port() == "" {
+			hostport = net.JoinHostPort(req.URL.Hostname(), "80")
+		}
+		addr, err := NewAddr("tcp", hostport)
+		if err != nil {
+			httpError(conn, http.StatusBadRequest)
+			return
+		}
+		addr = s.realAddr(addr)
+		m := s.away.ResloveModeWith(umode, addr)
+		if m == ModeDrop {
+			log.Infof("%c %s->%s", m, clientName(client), addr.String())
+			io.Copy(ioutil.Discard, req.Body)
+			httpError(conn, http.StatusForbidden)
+			continue
+		}
+
+		if uc == nil || uaddr != addr.String() {
+			if uc != nil {
+				uc.Close()
+			}
+			ac, am, _, err := s.dial(addr, m)
+			if err != nil {
+				log.Warnf("Dial %c %s failure: %s", am, addr.String(), err)
+				uc = nil
+				httpError(conn, http.StatusBadGateway)
+				return
+			}
+			uc = &idleConn{ac, relayTimeout}
+			ur, uaddr = bufio.NewReader(uc), addr.String()
+			m = am
+		}
+		log.Infof("%c %s->%s %s %s", m, clientName(client), addr.String(), req.Method, req.URL.Path)
+
+		for _, h := range []string{"Proxy-Connection", "Proxy-Authorization", "Keep-Alive"} {
+			req.Header.Del(h)
+		}
+		if err := req.Write(uc); err != nil {
+			log.Warn("Relay request failure: ", err)
+			httpError(conn, http.StatusBadGateway)
+			return
+		}
+		resp, err := http.ReadResponse(ur, req)
+		if err != nil {
+			log.Warn("Relay response failure: ", err)
+			httpError(conn, http.StatusBadGateway)
+			return
+		}
+
+		// The response streams for as long as both ends make progress
+		out := &idleConn{conn, relayTimeout}
+		if resp.StatusCode == http.StatusSwitchingProtocols {
+			if err := resp.Write(out); err != nil {
+				return
+			}
+			relay(uc, conn)
+			return
+		}
+
+		err = resp.Write(out)
+		resp.Body.Close()
+		if err != nil || req.Close || resp.Close {
+			return
+		}
+	}
+}
+
+// proxyAuth returns the Basic credentials in the Proxy-Authorization header.
+func proxyAuth(req *http.Request) (user, pass string, ok bool) {
+	r := &http.Request{Header: http.Header{"Authorization": req.Header["Proxy-Authorization"]}}
+	return r.BasicAuth()
+}
+
+func httpError(conn net.Conn, code int) {
+	fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\nContent-Length: 0\r\n\r\n", code, http.StatusText(code))
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const handshakeTimeout = 10 * time.Second
+
+// maxRejecting bounds the rejections answered at once, others being closed
+// at once so that a flood costs no more than the cap allows.
+const maxRejecting = 64
+
+// statusPath is where the local HTTP port serves its counters.
+const statusPath = "/status"
+
+var (
+	errTooManyConns   = errors.New("too many connections")
+	errTooManyConnsIP = errors.New("too many connections from client")
+)
+
+// limiter caps the connections served at once, overall and per client IP,
+// zero meaning no cap.
+type limiter struct {
+	max   int
+	perIP int
+
+	mu    sync.Mutex
+	total int
+	ips   map[string]int
+
+	rejected  uint64
+	rejecting chan struct{}
+}
+
+func newLimiter(max, perIP int) *limiter {
+	return &limiter{
+		max:       max,
+		perIP:     perIP,
+		ips:       make(map[string]int),
+		rejecting: make(chan struct{}, maxRejecting),
+	}
+}
+
+// acquire takes a slot for a connection from ip, to be given back with release.
+func (l *limiter) acquire(ip net.IP) error {
+	k := ip.String()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.max > 0 && l.total >= l.max {
+		return errTooManyConns
+	}
+	if l.perIP > 0 && l.ips[k] >= l.perIP {
+		return errTooManyConnsIP
+	}
+	l.total++
+	l.ips[k]++
+	return nil
+}
+
+func (l *limiter) release(ip net.IP) {
+	k := ip.String()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.total--
+	if l.ips[k]--; l.ips[k] <= 0 {
+		delete(l.ips, k)
+	}
+}
+
+// reject counts and logs the rejection of the client at addr.
+func (l *limiter) reject(addr net.Addr, err error) {
+	n := atomic.AddUint64(&l.rejected, 1)
+	log.Warnf("Client %s rejected: %s, %d rejected so far", addr.String(), err, n)
+}
+
+// status tells the active connections, from how many clients, and those
+// rejected so far.
+func (l *limiter) status() string {
+	l.mu.Lock()
+	total, ips := l.total, len(l.ips)
+	l.mu.Unlock()
+	return fmt.Sprintf("active: %d\nclients: %d\nrejected: %d\n",
+		total, ips, atomic.LoadUint64(&l.rejected))
+}
+
+// serveStatus answers req with the counters of the limiter.
+func (s *SocksSrv) serveStatus(conn net.Conn, req *http.Request) error {
+	st := s.limits.status()
+	resp := &http.Response{
+		StatusCode:    http.StatusOK,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"text/plain; charset=utf-8"}},
+		Body:          ioutil.NopCloser(strings.NewReader(st)),
+		ContentLength: int64(len(st)),
+		Close:         req.Close,
+	}
+	return resp.Write(conn)
+}
+
+// reject counts conn as rejected and turns it down in the protocol it
+// speaks, or just closes it when too many are being turned down already.
+func (s *SocksSrv) reject(conn net.Conn, err error) {
+	s.limits.reject(conn.RemoteAddr(), err)
+	select {
+	case s.limits.rejecting <- struct{}{}:
+	default:
+		conn.Close()
+		return
+	}
+	go func() {
+		defer func() { <-s.limits.rejecting }()
+		s.refuse(conn)
+	}()
+}
+
+// refuse answers conn with a rejection within the handshake timeout.
+func (s *SocksSrv) refuse(conn net.Conn) {
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(s.handshake))
+	r := bufio.NewReader(conn)
+	b, err := r.Peek(2)
+	if err != nil {
+		return
+	}
+	switch b[0] {
+	case 5:
+		if _, err := r.Discard(2 + int(b[1])); err != nil {
+			return
+		}
+		conn.Write([]byte{5, methodNoAcceptable})
+	case 4:
+		if _, err := r.Discard(8); err != nil {
+			return
+		}
+		readCString(r)
+		reply4(conn, rep4Rejected)
+	default:
+		if req, err := http.ReadRequest(r); err == nil {
+			io.Copy(ioutil.Discard, io.LimitReader(req.Body, 64*1024))
+		}
+		io.WriteString(conn, "HTTP/1.1 503 Service Unavailable\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+	}
+}
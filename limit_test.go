@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	a, b := net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2")
+	tests := []struct {
+		max, perIP int
+		acquire    []net.IP
+		want       []error
+	}{
+		{0, 0, []net.IP{a, a, b}, []error{nil, nil, nil}},
+		{2, 0, []net.IP{a, b, a}, []error{nil, nil, errTooManyConns}},
+		{0, 1, []net.IP{a, b, a, b}, []error{nil, nil, errTooManyConnsIP, errTooManyConnsIP}},
+		{3, 2, []net.IP{a, a, a, b, b}, []error{nil, nil, errTooManyConnsIP, nil, errTooManyConns}},
+	}
+	for i, tt := range tests {
+		l := newLimiter(tt.max, tt.perIP)
+		var held []net.IP
+		for j, ip := range tt.acquire {
+			err := l.acquire(ip)
+			if err != tt.want[j] {
+				t.Errorf("%d: acquire #%d %s = %v, want %v", i, j, ip, err, tt.want[j])
+			}
+			if err == nil {
+				held = append(held, ip)
+			}
+		}
+
+		// The slots given back can all be taken again.
+		for _, ip := range held {
+			l.release(ip)
+		}
+		if l.total != 0 || len(l.ips) != 0 {
+			t.Errorf("%d: after release total %d, ips %v, want none", i, l.total, l.ips)
+		}
+		for j, ip := range held {
+			if err := l.acquire(ip); err != nil {
+				t.Errorf("%d: reacquire #%d %s = %v", i, j, ip, err)
+			}
+		}
+	}
+}
+
+func TestReject(t *testing.T) {
+	tests := []struct {
+		req  string
+		want string
+	}{
+		{"\x05\x01\x00", "\x05\xff"},
+		{"\x04\x01\x00\x50\x7f\x00\x00\x01user\x00", "\x00\x5b\x00\x00\x00\x00\x00\x00"},
+		{"GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n", "HTTP/1.1 503 "},
+	}
+	s := &SocksSrv{limits: newLimiter(1, 0), handshake: time.Second}
+	for _, tt := range tests {
+		c, conn := net.Pipe()
+		go s.reject(conn, errTooManyConns)
+		go c.Write([]byte(tt.req))
+		b, _ := ioutil.ReadAll(c)
+		if !bytes.HasPrefix(b, []byte(tt.want)) {
+			t.Errorf("reject %q = %q, want %q", tt.req, b, tt.want)
+		}
+		c.Close()
+	}
+}
+
+func TestLimiterStatus(t *testing.T) {
+	l := newLimiter(1, 0)
+	a := net.ParseIP("192.0.2.1")
+	l.acquire(a)
+	if err := l.acquire(a); err != nil {
+		l.reject(&net.TCPAddr{IP: a}, err)
+	}
+	if got, want := l.status(), "active: 1\nclients: 1\nrejected: 1\n"; got != want {
+		t.Errorf("status = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// listener is a listening socket with the mode its connections default to,
+// zero meaning the current mode of Away.
+type listener struct {
+	net.Listener
+	mode rune
+}
+
+// parseListen parses a listen address optionally prefixed with a mode,
+// eg: "127.0.0.1:1080", "~[::]:1080", "*unix:///run/away.sock".
+func parseListen(spec string) (network, address string, mode rune, err error) {
+	if spec == "" {
+		return "", "", 0, fmt.Errorf("Empty listen address")
+	}
+	switch m := rune(spec[0]); m {
+	case ModeRule, ModeAway, ModePass, ModeDrop:
+		mode = m
+		spec = spec[1:]
+	}
+
+	if strings.HasPrefix(spec, "unix://") {
+		return "unix", strings.TrimPrefix(spec, "unix://"), mode, nil
+	}
+	if _, _, err := net.SplitHostPort(spec); err != nil {
+		return "", "", 0, fmt.Errorf("Invalid listen address %s, %s", spec, err)
+	}
+	return "tcp", spec, mode, nil
+}
+
+func listen(spec string) (*listener, error) {
+	network, address, mode, err := parseListen(spec)
+	if err != nil {
+		return nil, err
+	}
+	if network == "unix" {
+		if fi, err := os.Stat(address); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			os.Remove(address) // stale socket from a previous run
+		}
+	}
+	l, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return &listener{Listener: l, mode: mode}, nil
+}
+
+// checkNoMode fails on the first listen address prefixed by a mode, for
+// the remote which has none.
+func checkNoMode(specs []string) error {
+	for _, spec := range specs {
+		_, _, mode, err := parseListen(spec)
+		if err != nil {
+			return err
+		}
+		if mode != 0 {
+			return fmt.Errorf("Invalid listen address %s, the remote takes no mode", spec)
+		}
+	}
+	return nil
+}
+
+// listenAll listens on the addresses of s, or on its port of host when none
+// is given, empty host meaning every interface.
+func listenAll(s *Settings, host string) ([]*listener, error) {
+	specs := s.Listen
+	if len(specs) == 0 && s.Port != "" {
+		specs = []string{net.JoinHostPort(host, s.Port)}
+	}
+
+	ls := make([]*listener, 0, len(specs))
+	for _, spec := range specs {
+		l, err := listen(spec)
+		if err != nil {
+			closeListeners(ls)
+			return nil, err
+		}
+		ls = append(ls, l)
+	}
+	return ls, nil
+}
+
+func closeListeners(ls []*listener) {
+	for _, l := range ls {
+		l.Close()
+	}
+}
+
+// connIP returns the IP of a, loopback for non IP sockets.
+func connIP(a net.Addr) net.IP {
+	switch a := a.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+	return net.IPv4(127, 0, 0, 1)
+}
@@ -0,0 +1,54 @@
+package main
+
+import "testing"
+
+func TestParseListen(t *testing.T) {
+	tests := []struct {
+		spec    string
+		network string
+		address string
+		mode    rune
+		err     bool
+	}{
+		{"127.0.0.1:1080", "tcp", "127.0.0.1:1080", 0, false},
+		{":1080", "tcp", ":1080", 0, false},
+		{"~0.0.0.0:1080", "tcp", "0.0.0.0:1080", ModeAway, false},
+		{"*[::1]:1081", "tcp", "[::1]:1081", ModeRule, false},
+		{"@localhost:1082", "tcp", "localhost:1082", ModePass, false},
+		{"!127.0.0.1:1083", "tcp", "127.0.0.1:1083", ModeDrop, false},
+		{"unix:///run/away.sock", "unix", "/run/away.sock", 0, false},
+		{"~unix:///run/away.sock", "unix", "/run/away.sock", ModeAway, false},
+		{"", "", "", 0, true},
+		{"~", "", "", 0, true},
+		{"1080", "", "", 0, true},
+		{"::1:1080", "", "", 0, true},
+	}
+	for _, tt := range tests {
+		network, address, mode, err := parseListen(tt.spec)
+		if (err != nil) != tt.err {
+			t.Errorf("parseListen(%q) error %v, want error %v", tt.spec, err, tt.err)
+			continue
+		}
+		if network != tt.network || address != tt.address || mode != tt.mode {
+			t.Errorf("parseListen(%q) = %s %s %q, want %s %s %q", tt.spec, network, address, mode, tt.network, tt.address, tt.mode)
+		}
+	}
+}
+
+func TestCheckNoMode(t *testing.T) {
+	tests := []struct {
+		specs []string
+		err   bool
+	}{
+		{nil, false},
+		{[]string{"0.0.0.0:8080", "unix:///run/away-remote.sock"}, false},
+		{[]string{"0.0.0.0:8080", "~0.0.0.0:8081"}, true},
+		{[]string{"@unix:///run/away-remote.sock"}, true},
+		{[]string{"8080"}, true},
+	}
+	for _, tt := range tests {
+		if err := checkNoMode(tt.specs); (err != nil) != tt.err {
+			t.Errorf("checkNoMode(%q) error %v, want error %v", tt.specs, err, tt.err)
+		}
+	}
+}
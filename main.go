@@ -4,6 +4,7 @@ package main
 
 import (
 	"flag"
+	"strings"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -12,20 +13,116 @@ func main() {
 
 	rp := flag.String("rp", "", "Remote Port. eg: -rp 8080")
 	lp := flag.String("lp", "", "Local Port. eg: -lp 1080")
+	ra := flag.String("ra", "", "Remote listen Addresses instead of port, comma separated. eg: -ra 0.0.0.0:8080,unix:///run/away-remote.sock")
+	la := flag.String("la", "", "Local listen Addresses instead of port, comma separated, each optionally prefixed by a mode. eg: -la ~0.0.0.0:1080,*127.0.0.1:1081,unix:///run/away.sock")
 	pk := flag.String("pk", "AwayPasskey", "Passkey to do crypto. eg: -pk \"Away Passkey\"")
-	ru := flag.String("ru", "", "Remote Url to connect. eg: -ru http://away.remote")
+	ru := flag.String("ru", "", "Remote Url to connect, over websocket for http:// and https://, HTTP/2 for h2:// and h2c://, or raw tcp:// and tls://. eg: -ru http://away.remote")
 	rf := flag.String("rf", "", "Rules File use to initilize rules. eg: /path/rules")
+	tp := flag.String("tp", "", "Transparent Port for connections redirected by iptables REDIRECT. eg: -tp 1081")
+	xp := flag.String("xp", "", "TProxy Port for TCP and UDP diverted by iptables TPROXY. eg: -xp 1082")
+	lf := flag.String("lf", "", "Local Forwards through remote, comma separated listen=host:port. eg: -lf 127.0.0.1:15432=db.internal:5432")
+	lr := flag.String("lr", "", "Local services exposed on the Remote, comma separated remote-listen=host:port. eg: -lr 0.0.0.0:2222=127.0.0.1:22")
+	ap := flag.String("ap", "", "Allowed Ports the remote may listen on for reverse tunnels, comma separated ports or ranges, optionally for a certificate user only. eg: -ap 2222,8000-8100,alice=2223")
+	uf := flag.String("uf", "", "Users File of user:password lines to require authentication, each optionally prefixed by the mode the user is routed in. eg: /path/users")
+	dl := flag.String("dl", "", "DNS Listen address resolving names the way they are routed, optionally prefixed by a mode. eg: -dl 127.0.0.1:5353")
+	dr := flag.String("dr", "", "DNS Resolver for direct names, and for the remote, defaults to the system one. eg: -dr 1.1.1.1:53")
+	fi := flag.String("fi", "", "Fake IP range the DNS server hands out, for transparent proxying to route by name. eg: -fi 198.18.0.0/15")
+	sn := flag.Bool("sn", false, "Sniff the TLS SNI or HTTP Host of connections to IPs to route them by name. eg: -sn")
+	ca := flag.String("ca", "", "Client Addresses allowed to use local, comma separated CIDRs or IPs, only loopback by default which also binds -lp to loopback. eg: -ca 192.168.1.0/24")
+	cd := flag.String("cd", "", "Client addresses Denied, comma separated CIDRs or IPs, taking precedence over -ca. eg: -cd 192.168.1.13")
+	ht := flag.Duration("ht", handshakeTimeout, "Handshake Timeout for local clients to send their request. eg: -ht 5s")
+	mc := flag.Int("mc", 0, "Max Connections served by local at once, 0 for no limit. eg: -mc 1024")
+	mi := flag.Int("mi", 0, "Max connections served by local at once per client IP, 0 for no limit. eg: -mi 256")
+	tn := flag.String("tn", "", "Tun device Name to route the traffic of, created when missing, linux only. eg: -tn away0")
+	mx := flag.Int("mx", 0, "Mux sessions carrying all the tunnels to the remote, 0 for a websocket per connection. eg: -mx 2")
+	wp := flag.Int("wp", 0, "Warm Pool of idle websockets kept open to the remote for tunnels to start at once, 0 for none. eg: -wp 4")
+	rc := flag.String("rc", "", "Remote CA bundle file to verify the remote certificate with instead of the system CAs. eg: -rc /path/ca.pem")
+	pn := flag.String("pn", "", "Pins of the remote certificate public key, comma separated, trusting a self-signed one without -rc. eg: -pn sha256/47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=")
+	cert := flag.String("cert", "", "Certificate file for the remote to serve TLS with, self-signed and saved along -key when both are missing. eg: -cert /path/away.crt")
+	key := flag.String("key", "", "Key file of the remote TLS certificate. eg: -key /path/away.key")
+	clientCA := flag.String("client-ca", "", "Client CA bundle file the remote requires local certificates of, authenticating users by their subject. eg: -client-ca /path/users-ca.pem")
+	crl := flag.String("crl", "", "Certificate Revocation List file of -client-ca, reloaded on SIGHUP. eg: -crl /path/users.crl")
+	clientCert := flag.String("client-cert", "", "Client certificate file local presents to the remote. eg: -client-cert /path/alice.crt")
+	clientKey := flag.String("client-key", "", "Key file of the local client certificate. eg: -client-key /path/alice.key")
+	ws := flag.String("ws", wsPath, "WebSocket path the remote serves and local dials. eg: -ws /chat/socket")
+	hh := flag.String("hh", "", "Host Header sent to the remote instead of the URL host, to front a domain behind a CDN. eg: -hh away.example.com")
+	sni := flag.String("sni", "", "TLS Server Name Indication sent instead of the URL host. eg: -sni cdn.example.com")
+	ua := flag.String("ua", "", "User-Agent sent over websocket and HTTP/2. eg: -ua \"Mozilla/5.0\"")
+	var hd listFlag
+	flag.Var(&hd, "hd", "Header sent over websocket and HTTP/2 as Name: value, repeatable. eg: -hd \"X-Away-Token: secret\"")
+	tk := flag.String("tk", "", "Token header the remote requires on websocket and HTTP/2 requests, serving the site to others and refusing raw streams. eg: -tk \"X-Away-Token: secret\"")
 	flag.Parse()
 
+	// Left unset, the passkey gives way to client certificates
+	passkey, localPasskey := *pk, *pk
+	if !flagSet("pk") {
+		if *clientCA != "" {
+			passkey = ""
+		}
+		if *clientCert != "" {
+			localPasskey = ""
+		}
+	}
+
 	log.SetFormatter(&log.TextFormatter{FullTimestamp: true, TimestampFormat: "2006/01/02 15:04:05.000"})
 
-	if *rp != "" && *lp != "" {
-		go startSocks(*lp, *pk, *rp, *ru, *rf)
-		startRemote(*rp, *pk)
-	} else if *rp != "" {
-		startRemote(*rp, *pk)
+	rs := &Settings{
+		Passkey:  passkey,
+		Port:     *rp,
+		Listen:   splitList(*ra),
+		Resolver: *dr,
+		Cert:     *cert,
+		Key:      *key,
+		ClientCA: *clientCA,
+		CRL:      *crl,
+		WSPath:   *ws,
+		Token:    *tk,
+
+		ReversePorts: splitList(*ap),
+	}
+	ls := &Settings{
+		Remote:     defaultVal(*ru, "http://localhost:"+*rp),
+		Passkey:    localPasskey,
+		Port:       *lp,
+		Listen:     splitList(*la),
+		Users:      *uf,
+		RedirPort:  *tp,
+		TProxyPort: *xp,
+		Forwards:   splitList(*lf),
+		Reverses:   splitList(*lr),
+		DNS:        *dl,
+		Resolver:   *dr,
+		FakeIP:     *fi,
+		Sniff:      *sn,
+		Allow:      splitList(*ca),
+		Deny:       splitList(*cd),
+		Tun:        *tn,
+		Mux:        *mx,
+		Pool:       *wp,
+		RemoteCA:   *rc,
+		Pins:       splitList(*pn),
+		ClientCert: *clientCert,
+		ClientKey:  *clientKey,
+		WSPath:     *ws,
+		HostHeader: *hh,
+		SNI:        *sni,
+		UserAgent:  *ua,
+		Headers:    hd,
+
+		HandshakeTimeout: *ht,
+		MaxConns:         *mc,
+		MaxConnsPerIP:    *mi,
+	}
+
+	remote := *rp != "" || *ra != ""
+	local := *lp != "" || *la != "" || *lf != "" || *lr != "" || *dl != "" || *tn != ""
+	if remote && local {
+		go startSocks(ls, *rf)
+		startRemote(rs)
+	} else if remote {
+		startRemote(rs)
 	} else {
-		startSocks(*lp, *pk, *rp, *ru, *rf)
+		startSocks(ls, *rf)
 	}
 
 }
@@ -37,21 +134,29 @@ func defaultVal(origin, value string) string {
 	return value
 }
 
-func startRemote(rp, pk string) {
-	s := &Settings{
-		Passkey: pk,
-		Port:    rp,
-	}
-	Remote(s)
+// flagSet tells whether the flag name was given.
+func flagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
 }
 
-func startSocks(lp, pk, rp, ru, rf string) {
-	s := &Settings{
-		Remote:  defaultVal(ru, "http://localhost:"+rp),
-		Passkey: pk,
-		Port:    lp,
+func splitList(value string) []string {
+	if value == "" {
+		return nil
 	}
+	return strings.Split(value, ",")
+}
+
+func startRemote(s *Settings) {
+	Remote(s)
+}
 
+func startSocks(s *Settings, rf string) {
 	away := NewAway(ModeAway, rf)
 	if rf != "" {
 		n, err := away.LoadRules()
@@ -71,3 +176,15 @@ func startSocks(lp, pk, rp, ru, rf string) {
 	}
 	srv.Start()
 }
+
+// listFlag collects the values of a repeatable flag.
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ", ")
+}
+
+func (l *listFlag) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
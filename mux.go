@@ -0,0 +1,649 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// A mux session carries many streams over one tunnel, opened by a cmdMux
+// request. Each stream is then served like a tunnel of its own, starting
+// with its request. Frames are
+// +------+-----------+-----+----------+
+// | TYPE | STREAM ID | LEN |   DATA   |
+// +------+-----------+-----+----------+
+// |  1   |     4     |  2  | Variable |
+// +------+-----------+-----+----------+
+// where a window frame carries the 4 byte increment of the sender's
+// receive window. Only the client opens streams, with odd IDs.
+
+const (
+	muxOpen   = 0
+	muxData   = 1
+	muxWindow = 2
+	muxClose  = 3 // no more data from the sender
+	muxReset  = 4 // the stream is aborted both ways
+)
+
+const (
+	muxMaxFrame   = 16 * 1024
+	muxMaxBatch   = 64 * 1024
+	muxWindowSize = 256 * 1024
+	muxMaxStreams = 256 // open at once on a session
+
+	muxIdleTimeout       = 60 * time.Second
+	muxRemoteIdleTimeout = 3 * time.Minute
+	muxRetry             = 5 * time.Minute
+)
+
+var (
+	errMuxClosed      = errors.New("mux stream closed")
+	errMuxReset       = errors.New("mux stream reset")
+	errMuxIdle        = errors.New("mux session idle")
+	errMuxProtocol    = errors.New("mux protocol violation")
+	errMuxFull        = errors.New("mux sessions full")
+	errMuxUnsupported = errors.New("remote does not multiplex")
+)
+
+// muxSession serves the streams of one tunnel. A single writer sends the
+// control frames first, then one data frame of each ready stream in turn.
+type muxSession struct {
+	conn   net.Conn
+	handle func(net.Conn) // serves the streams the peer opens, nil on client
+	idle   *time.Timer
+
+	mu      sync.Mutex
+	cond    *sync.Cond // wakes up the writer
+	streams map[uint32]*muxStream
+	nextID  uint32
+	ctrl    []byte
+	ready   []*muxStream
+	closed  bool
+	err     error
+	used    time.Time // when the last stream was removed
+}
+
+func newMuxSession(conn net.Conn, handle func(net.Conn), idle time.Duration) *muxSession {
+	s := &muxSession{
+		conn:    conn,
+		handle:  handle,
+		streams: make(map[uint32]*muxStream),
+		nextID:  1,
+		used:    time.Now(),
+	}
+	s.cond = sync.NewCond(&s.mu)
+	s.idle = time.AfterFunc(idle, func() {
+		s.mu.Lock()
+		switch left := idle - time.Since(s.used); {
+		case len(s.streams) > 0:
+			s.idle.Reset(idle)
+		case left > 0:
+			s.idle.Reset(left)
+		default:
+			s.shutdown(errMuxIdle)
+		}
+		closed := s.closed
+		s.mu.Unlock()
+		if closed {
+			s.conn.Close()
+		}
+	})
+	go s.write()
+	return s
+}
+
+// serveMux serves the streams of a session opened by a client until it
+// is over.
+func serveMux(conn net.Conn, handle func(net.Conn)) {
+	s := newMuxSession(conn, handle, muxRemoteIdleTimeout)
+	log.Infof("Mux session from %s", clientName(conn))
+	s.read()
+}
+
+// open opens a new stream to the peer.
+func (s *muxSession) open() (*muxStream, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil, s.err
+	}
+	if len(s.streams) >= muxMaxStreams {
+		return nil, errMuxFull
+	}
+	st := s.newStream(s.nextID)
+	s.nextID += 2
+	s.control(muxOpen, st.id, nil)
+	return st, nil
+}
+
+func (s *muxSession) newStream(id uint32) *muxStream {
+	st := &muxStream{sess: s, id: id, sndWnd: muxWindowSize}
+	st.cond = sync.NewCond(&s.mu)
+	s.streams[id] = st
+	return st
+}
+
+// load is the number of streams open on the session.
+func (s *muxSession) load() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.streams)
+}
+
+func (s *muxSession) Close() error {
+	s.fail(errMuxClosed)
+	return nil
+}
+
+// fail closes the session and every stream on it with err.
+func (s *muxSession) fail(err error) {
+	s.mu.Lock()
+	s.shutdown(err)
+	s.mu.Unlock()
+	s.conn.Close()
+}
+
+// shutdown is fail with s.mu held, but leaves closing the conn to the
+// caller as it may block on a pending write.
+func (s *muxSession) shutdown(err error) {
+	if s.closed {
+		return
+	}
+	s.closed = true
+	s.err = err
+	for _, st := range s.streams {
+		st.err = err
+		st.cond.Broadcast()
+	}
+	s.streams = nil
+	s.cond.Broadcast()
+	s.idle.Stop()
+
+	if err != errMuxIdle && err != errMuxClosed && err != io.EOF {
+		log.Warnf("Mux session %s failure: %s", clientName(s.conn), err)
+	}
+}
+
+// control queues a control frame, with s.mu held.
+func (s *muxSession) control(typ byte, id uint32, data []byte) {
+	s.ctrl = appendFrame(s.ctrl, typ, id, data)
+	s.cond.Signal()
+}
+
+// schedule queues st for the writer if it has anything to send, with s.mu
+// held.
+func (s *muxSession) schedule(st *muxStream) {
+	if st.queued || st.err != nil || st.closeSent {
+		return
+	}
+	if len(st.outq) > 0 && st.sndWnd > 0 || len(st.outq) == 0 && st.closing {
+		st.queued = true
+		s.ready = append(s.ready, st)
+		s.cond.Signal()
+	}
+}
+
+// remove forgets st, with s.mu held.
+func (s *muxSession) remove(st *muxStream) {
+	if s.streams[st.id] != st {
+		return
+	}
+	delete(s.streams, st.id)
+	if len(s.streams) == 0 {
+		s.used = time.Now()
+	}
+}
+
+func appendFrame(b []byte, typ byte, id uint32, data []byte) []byte {
+	var hdr [7]byte
+	hdr[0] = typ
+	binary.BigEndian.PutUint32(hdr[1:5], id)
+	binary.BigEndian.PutUint16(hdr[5:7], uint16(len(data)))
+	return append(append(b, hdr[:]...), data...)
+}
+
+func (s *muxSession) write() {
+	var buf []byte
+	for {
+		s.mu.Lock()
+		for !s.closed && len(s.ctrl) == 0 && len(s.ready) == 0 {
+			s.cond.Wait()
+		}
+		if s.closed {
+			s.mu.Unlock()
+			return
+		}
+		buf = append(buf[:0], s.ctrl...)
+		s.ctrl = s.ctrl[:0]
+		for len(s.ready) > 0 && len(buf) < muxMaxBatch {
+			st := s.ready[0]
+			s.ready = s.ready[1:]
+			st.queued = false
+			buf = st.frame(buf)
+			s.schedule(st)
+		}
+		s.mu.Unlock()
+
+		if _, err := s.conn.Write(buf); err != nil {
+			s.fail(err)
+			return
+		}
+	}
+}
+
+func (s *muxSession) read() {
+	hdr := make([]byte, 7)
+	buf := make([]byte, muxMaxFrame)
+	for {
+		if _, err := io.ReadFull(s.conn, hdr); err != nil {
+			s.fail(err)
+			return
+		}
+		typ, id := hdr[0], binary.BigEndian.Uint32(hdr[1:5])
+		l := int(binary.BigEndian.Uint16(hdr[5:7]))
+		if l > muxMaxFrame {
+			s.fail(errMuxProtocol)
+			return
+		}
+		if _, err := io.ReadFull(s.conn, buf[:l]); err != nil {
+			s.fail(err)
+			return
+		}
+		if err := s.input(typ, id, buf[:l]); err != nil {
+			s.fail(err)
+			return
+		}
+	}
+}
+
+func (s *muxSession) input(typ byte, id uint32, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	st := s.streams[id]
+
+	if typ == muxOpen {
+		if s.handle == nil || st != nil || id%2 == 0 {
+			return errMuxProtocol
+		}
+		if len(s.streams) >= muxMaxStreams {
+			log.Warnf("Mux %s stream refused, %d streams open", clientName(s.conn), len(s.streams))
+			s.control(muxReset, id, nil)
+			return nil
+		}
+		st = s.newStream(id)
+		go s.handle(st)
+		return nil
+	}
+
+	if st == nil {
+		// Closed here already, tell the peer to stop sending.
+		if typ == muxData {
+			s.control(muxReset, id, nil)
+		}
+		return nil
+	}
+	switch typ {
+	case muxData:
+		if st.closing {
+			st.err = errMuxClosed
+			s.remove(st)
+			s.control(muxReset, id, nil)
+			return nil
+		}
+		if st.finRcvd || len(st.rbuf)+len(data) > muxWindowSize {
+			return errMuxProtocol
+		}
+		st.rbuf = append(st.rbuf, data...)
+	case muxWindow:
+		if len(data) != 4 {
+			return errMuxProtocol
+		}
+		st.sndWnd += int(binary.BigEndian.Uint32(data))
+		s.schedule(st)
+	case muxClose:
+		st.finRcvd = true
+	case muxReset:
+		st.err = errMuxReset
+		st.outq = nil
+		s.remove(st)
+	default:
+		return errMuxProtocol
+	}
+	st.cond.Broadcast()
+	return nil
+}
+
+// muxStream is a stream of a mux session, with its own flow control:
+// the peer never has more than muxWindowSize bytes unread in flight.
+type muxStream struct {
+	sess *muxSession
+	id   uint32
+	cond *sync.Cond // on sess.mu
+
+	// Receive side
+	rbuf     []byte
+	consumed int // read since the last window update
+	finRcvd  bool
+
+	// Send side
+	sndWnd    int
+	outq      []byte
+	queued    bool // on the ready list of the writer
+	closing   bool
+	closeSent bool
+
+	err error // reset or session failure
+
+	rdl, wdl deadline
+}
+
+// frame appends the next frame of st to b, with sess.mu held.
+func (st *muxStream) frame(b []byte) []byte {
+	if st.err != nil {
+		return b
+	}
+	n := len(st.outq)
+	if n > st.sndWnd {
+		n = st.sndWnd
+	}
+	if n > muxMaxFrame {
+		n = muxMaxFrame
+	}
+	if n > 0 {
+		b = appendFrame(b, muxData, st.id, st.outq[:n])
+		st.outq = st.outq[n:]
+		if len(st.outq) == 0 {
+			st.outq = nil
+		}
+		st.sndWnd -= n
+		st.cond.Broadcast()
+	}
+	if len(st.outq) == 0 && st.closing {
+		b = appendFrame(b, muxClose, st.id, nil)
+		st.closeSent = true
+		st.sess.remove(st)
+	}
+	return b
+}
+
+func (st *muxStream) Read(b []byte) (int, error) {
+	s := st.sess
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for {
+		switch {
+		case st.closing:
+			return 0, errMuxClosed
+		case len(st.rbuf) > 0:
+			n := copy(b, st.rbuf)
+			st.rbuf = st.rbuf[n:]
+			if len(st.rbuf) == 0 {
+				st.rbuf = nil
+			}
+			st.consumed += n
+			if st.consumed >= muxWindowSize/2 && !st.finRcvd && st.err == nil {
+				var inc [4]byte
+				binary.BigEndian.PutUint32(inc[:], uint32(st.consumed))
+				s.control(muxWindow, st.id, inc[:])
+				st.consumed = 0
+			}
+			return n, nil
+		case st.finRcvd:
+			return 0, io.EOF
+		case st.err != nil:
+			return 0, st.err
+		case st.rdl.exceeded():
+			return 0, os.ErrDeadlineExceeded
+		}
+		st.cond.Wait()
+	}
+}
+
+// Write queues b for the writer, blocking while muxWindowSize bytes are
+// already waiting.
+func (st *muxStream) Write(b []byte) (int, error) {
+	s := st.sess
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for len(b) > 0 {
+		switch {
+		case st.err != nil:
+			return n, st.err
+		case st.closing:
+			return n, errMuxClosed
+		case st.wdl.exceeded():
+			return n, os.ErrDeadlineExceeded
+		}
+
+		room := muxWindowSize - len(st.outq)
+		if room <= 0 {
+			st.cond.Wait()
+			continue
+		}
+		if room > len(b) {
+			room = len(b)
+		}
+		st.outq = append(st.outq, b[:room]...)
+		b, n = b[room:], n+room
+		s.schedule(st)
+	}
+	return n, nil
+}
+
+// Close sends a close frame after the data written so far.
+func (st *muxStream) Close() error {
+	s := st.sess
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if st.closing {
+		return nil
+	}
+	st.closing = true
+	st.rbuf = nil
+	st.cond.Broadcast()
+	if st.err != nil {
+		return nil
+	}
+	s.schedule(st)
+	return nil
+}
+
+func (st *muxStream) LocalAddr() net.Addr  { return st.sess.conn.LocalAddr() }
+func (st *muxStream) RemoteAddr() net.Addr { return st.sess.conn.RemoteAddr() }
+
+func (st *muxStream) SetDeadline(t time.Time) error {
+	st.SetReadDeadline(t)
+	return st.SetWriteDeadline(t)
+}
+
+func (st *muxStream) SetReadDeadline(t time.Time) error {
+	st.sess.mu.Lock()
+	defer st.sess.mu.Unlock()
+	st.rdl.set(t, st.cond)
+	return nil
+}
+
+func (st *muxStream) SetWriteDeadline(t time.Time) error {
+	st.sess.mu.Lock()
+	defer st.sess.mu.Unlock()
+	st.wdl.set(t, st.cond)
+	return nil
+}
+
+// muxPool spreads the tunnels of a client over up to size sessions,
+// opening another one only when all of them are busy.
+type muxPool struct {
+	size int
+	dial func() (net.Conn, error)
+
+	mu          sync.Mutex
+	sessions    []*muxSession
+	dialing     int
+	first       *muxDial  // the dial opens wait for when no session is left
+	unsupported time.Time // until when the remote is taken as not multiplexing
+	closed      bool
+}
+
+// muxDial is a session being dialed, err being set once done is closed.
+type muxDial struct {
+	done chan struct{}
+	err  error
+}
+
+func newMuxPool(size int, dial func() (net.Conn, error)) *muxPool {
+	return &muxPool{size: size, dial: dial}
+}
+
+// open opens a stream on the least loaded session, or errMuxUnsupported
+// if the remote does not multiplex and errMuxFull if all sessions are. Sessions are dialed without holding
+// p.mu, so that a slow remote only holds up the opens needing them.
+func (p *muxPool) open() (net.Conn, error) {
+	for {
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			return nil, errMuxClosed
+		}
+		if time.Now().Before(p.unsupported) {
+			p.mu.Unlock()
+			return nil, errMuxUnsupported
+		}
+
+		var best *muxSession
+		bestLoad := 0
+		for _, s := range p.sessions {
+			if l := s.load(); best == nil || l < bestLoad {
+				best, bestLoad = s, l
+			}
+		}
+		if best == nil {
+			// Others wait for this session rather than dialing their own.
+			d := p.first
+			if d == nil {
+				d = &muxDial{done: make(chan struct{})}
+				p.first = d
+				p.dialing++
+				go p.grow(d)
+			}
+			p.mu.Unlock()
+			<-d.done
+			if d.err != nil {
+				return nil, d.err
+			}
+			continue
+		}
+		if bestLoad > 0 && len(p.sessions)+p.dialing < p.size {
+			p.dialing++
+			go p.grow(nil)
+		}
+		p.mu.Unlock()
+		if bestLoad >= muxMaxStreams {
+			return nil, errMuxFull
+		}
+
+		st, err := best.open()
+		if err == nil {
+			return st, nil
+		}
+		if err == errMuxFull {
+			return nil, err // filled meanwhile
+		}
+		p.mu.Lock()
+		p.remove(best) // closed meanwhile
+		p.mu.Unlock()
+	}
+}
+
+// grow dials another session, telling d the outcome when given.
+func (p *muxPool) grow(d *muxDial) {
+	s, err := p.dialSession()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.dialing--
+	if d != nil {
+		d.err = err
+		p.first = nil
+		close(d.done)
+	}
+	switch {
+	case err != nil:
+		p.failed(err)
+	case p.closed:
+		s.Close()
+	default:
+		p.sessions = append(p.sessions, s)
+	}
+}
+
+// dialSession opens a session, or fails with errMuxUnsupported when the
+// remote turns the request down.
+func (p *muxPool) dialSession() (*muxSession, error) {
+	conn, err := p.dial()
+	if err != nil {
+		return nil, err
+	}
+	if err := writeRequest(conn, cmdMux, zeroAddr); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if _, err := readReply(conn, "tcp"); err != nil {
+		conn.Close()
+		if err == repError(repCmdNotSupported) || err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, errMuxUnsupported
+		}
+		return nil, err
+	}
+
+	s := newMuxSession(conn, nil, muxIdleTimeout)
+	go func() {
+		s.read()
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		p.remove(s)
+	}()
+	log.Infof("Mux session to %s", conn.RemoteAddr())
+	return s, nil
+}
+
+// failed notes a failure to open a session, with p.mu held.
+func (p *muxPool) failed(err error) {
+	if err == errMuxUnsupported {
+		log.Info("Remote does not multiplex, using a websocket per connection")
+		p.unsupported = time.Now().Add(muxRetry)
+	} else {
+		log.Warn("Mux session failure: ", err)
+	}
+}
+
+// remove forgets s, with p.mu held.
+func (p *muxPool) remove(s *muxSession) {
+	for i, c := range p.sessions {
+		if c == s {
+			p.sessions = append(p.sessions[:i], p.sessions[i+1:]...)
+			return
+		}
+	}
+}
+
+func (p *muxPool) Close() error {
+	p.mu.Lock()
+	sessions := p.sessions
+	p.sessions = nil
+	p.closed = true
+	p.mu.Unlock()
+	for _, s := range sessions {
+		s.Close()
+	}
+	return nil
+}
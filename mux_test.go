@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// muxRemote serves a mux session on the remote end of a pipe, echoing
+// the streams after their request.
+func muxRemote(t *testing.T) net.Conn {
+	c, rc := net.Pipe()
+	go func() {
+		defer rc.Close()
+		if cmd, _, err := readRequest(rc); err != nil || cmd != cmdMux {
+			return
+		}
+		if _, err := reply(rc, repSucceeded, nil); err != nil {
+			return
+		}
+		serveMux(rc, func(st net.Conn) {
+			defer st.Close()
+			if _, _, err := readRequest(st); err != nil {
+				return
+			}
+			io.Copy(st, st)
+		})
+	}()
+	return c
+}
+
+func TestMuxPoolDialsOutsideLock(t *testing.T) {
+	release := make(chan struct{})
+	dials := 0
+	p := newMuxPool(2, func() (net.Conn, error) {
+		if dials++; dials > 1 {
+			<-release // the remote got slow
+		}
+		return muxRemote(t), nil
+	})
+	defer p.Close()
+	defer close(release)
+
+	first, err := p.open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+
+	// The first session being busy, another is dialed in the background
+	// while opens go on over the first one.
+	opened := make(chan error, 1)
+	go func() {
+		st, err := p.open()
+		if err == nil {
+			st.Close()
+		}
+		opened <- err
+	}()
+	select {
+	case err := <-opened:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("open blocked behind a session dial")
+	}
+}
+
+func TestMuxPoolSharesFirstDial(t *testing.T) {
+	release := make(chan struct{})
+	dials := make(chan struct{}, 10)
+	p := newMuxPool(4, func() (net.Conn, error) {
+		dials <- struct{}{}
+		<-release
+		return muxRemote(t), nil
+	})
+	defer p.Close()
+
+	errs := make(chan error, 3)
+	for i := 0; i < 3; i++ {
+		go func() {
+			st, err := p.open()
+			if err == nil {
+				st.Close()
+			}
+			errs <- err
+		}()
+	}
+	<-dials
+	time.Sleep(50 * time.Millisecond)
+	if n := len(dials); n != 0 {
+		t.Errorf("%d more sessions dialed with none open, want them to wait for the first", n)
+	}
+	close(release)
+	for i := 0; i < 3; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+type testFrame struct {
+	typ  byte
+	id   uint32
+	data []byte
+}
+
+func readFrame(t *testing.T, r io.Reader) testFrame {
+	hdr := make([]byte, 7)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		t.Fatal(err)
+	}
+	f := testFrame{typ: hdr[0], id: binary.BigEndian.Uint32(hdr[1:5])}
+	f.data = make([]byte, binary.BigEndian.Uint16(hdr[5:7]))
+	if _, err := io.ReadFull(r, f.data); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func windowFrame(id uint32, inc int) []byte {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], uint32(inc))
+	return appendFrame(nil, muxWindow, id, b[:])
+}
+
+func TestAppendFrame(t *testing.T) {
+	tests := []struct {
+		typ  byte
+		id   uint32
+		data []byte
+		want []byte
+	}{
+		{muxOpen, 1, nil, []byte{0, 0, 0, 0, 1, 0, 0}},
+		{muxData, 3, []byte("hi"), []byte{1, 0, 0, 0, 3, 0, 2, 'h', 'i'}},
+		{muxWindow, 0x01020304, []byte{0, 1, 0, 0}, []byte{2, 1, 2, 3, 4, 0, 4, 0, 1, 0, 0}},
+		{muxClose, 0xffffffff, nil, []byte{3, 0xff, 0xff, 0xff, 0xff, 0, 0}},
+		{muxReset, 5, nil, []byte{4, 0, 0, 0, 5, 0, 0}},
+	}
+	for _, tt := range tests {
+		got := appendFrame([]byte{9}, tt.typ, tt.id, tt.data)
+		if !bytes.Equal(got[1:], tt.want) || got[0] != 9 {
+			t.Errorf("appendFrame(%d, %d, %q) = %v, want %v", tt.typ, tt.id, tt.data, got[1:], tt.want)
+		}
+		f := readFrame(t, bytes.NewReader(got[1:]))
+		if f.typ != tt.typ || f.id != tt.id || !bytes.Equal(f.data, tt.data) {
+			t.Errorf("frame of %v read as %d %d %q", tt.want, f.typ, f.id, f.data)
+		}
+	}
+}
+
+func TestMuxInput(t *testing.T) {
+	big := make([]byte, muxMaxFrame)
+	tests := []struct {
+		name   string
+		frames [][]byte
+		want   error
+		reset  bool // a reset is sent back
+	}{
+		{"open", [][]byte{appendFrame(nil, muxOpen, 1, nil)}, nil, false},
+		{"open even", [][]byte{appendFrame(nil, muxOpen, 2, nil)}, errMuxProtocol, false},
+		{"open twice", [][]byte{appendFrame(nil, muxOpen, 1, nil), appendFrame(nil, muxOpen, 1, nil)}, errMuxProtocol, false},
+		{"data unknown", [][]byte{appendFrame(nil, muxData, 7, []byte("x"))}, nil, true},
+		{"window unknown", [][]byte{windowFrame(7, 1)}, nil, false},
+		{"bad window", [][]byte{appendFrame(nil, muxOpen, 1, nil), appendFrame(nil, muxWindow, 1, []byte{1})}, errMuxProtocol, false},
+		{"unknown type", [][]byte{appendFrame(nil, muxOpen, 1, nil), appendFrame(nil, 9, 1, nil)}, errMuxProtocol, false},
+		{"data after close", [][]byte{appendFrame(nil, muxOpen, 1, nil), appendFrame(nil, muxClose, 1, nil),
+			appendFrame(nil, muxData, 1, []byte("x"))}, errMuxProtocol, false},
+		{"window full", func() [][]byte {
+			fs := [][]byte{appendFrame(nil, muxOpen, 1, nil)}
+			for n := 0; n < muxWindowSize; n += len(big) {
+				fs = append(fs, appendFrame(nil, muxData, 1, big))
+			}
+			return fs
+		}(), nil, false},
+		{"window overrun", func() [][]byte {
+			fs := [][]byte{appendFrame(nil, muxOpen, 1, nil)}
+			for n := 0; n <= muxWindowSize; n += len(big) {
+				fs = append(fs, appendFrame(nil, muxData, 1, big))
+			}
+			return fs
+		}(), errMuxProtocol, false},
+	}
+	for _, tt := range tests {
+		c, peer := net.Pipe()
+		s := newMuxSession(c, func(net.Conn) {}, time.Minute)
+		var err error
+		for _, f := range tt.frames {
+			r := bytes.NewReader(f)
+			ft := readFrame(t, r)
+			if err = s.input(ft.typ, ft.id, ft.data); err != nil {
+				break
+			}
+		}
+		if err != tt.want {
+			t.Errorf("%s: input error %v, want %v", tt.name, err, tt.want)
+		}
+		if tt.reset {
+			if f := readFrame(t, peer); f.typ != muxReset || f.id != 7 {
+				t.Errorf("%s: sent frame %d %d, want reset of 7", tt.name, f.typ, f.id)
+			}
+		}
+		s.Close()
+		peer.Close()
+	}
+}
+
+func TestMuxSendWindow(t *testing.T) {
+	c, peer := net.Pipe()
+	s := newMuxSession(c, nil, time.Minute)
+	defer s.Close()
+	go s.read()
+	st, err := s.open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f := readFrame(t, peer); f.typ != muxOpen || f.id != 1 {
+		t.Fatalf("frame %d %d, want open of 1", f.typ, f.id)
+	}
+
+	const size = muxWindowSize + 100*1024
+	go st.Write(make([]byte, size))
+
+	// Sends up to the window, in frames of muxMaxFrame at most
+	sent := 0
+	for sent < muxWindowSize {
+		f := readFrame(t, peer)
+		if f.typ != muxData || f.id != 1 || len(f.data) > muxMaxFrame {
+			t.Fatalf("frame %d %d of %d bytes, want data of 1", f.typ, f.id, len(f.data))
+		}
+		sent += len(f.data)
+	}
+	if sent != muxWindowSize {
+		t.Fatalf("sent %d bytes, want %d", sent, muxWindowSize)
+	}
+	peer.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := peer.Read(make([]byte, 1)); err == nil {
+		t.Fatal("sent past the window")
+	}
+	peer.SetReadDeadline(time.Time{})
+
+	// Then as much as the window grows
+	go peer.Write(windowFrame(1, 60*1024))
+	for sent < muxWindowSize+60*1024 {
+		sent += len(readFrame(t, peer).data)
+	}
+	if sent != muxWindowSize+60*1024 {
+		t.Fatalf("sent %d bytes, want %d", sent, muxWindowSize+60*1024)
+	}
+	go peer.Write(windowFrame(1, muxWindowSize))
+	for sent < size {
+		sent += len(readFrame(t, peer).data)
+	}
+	if sent != size {
+		t.Fatalf("sent %d bytes, want %d", sent, size)
+	}
+}
+
+func TestMuxReceiveWindow(t *testing.T) {
+	c, peer := net.Pipe()
+	s := newMuxSession(c, nil, time.Minute)
+	defer s.Close()
+	go s.read()
+	st, err := s.open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	readFrame(t, peer)
+
+	go func() {
+		for n := 0; n < muxWindowSize; n += muxMaxFrame {
+			peer.Write(appendFrame(nil, muxData, 1, make([]byte, muxMaxFrame)))
+		}
+	}()
+
+	// The window is given back once half of it is read
+	b := make([]byte, 1024)
+	read := 0
+	for read < muxWindowSize/2-len(b) {
+		n, err := st.Read(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		read += n
+	}
+	peer.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := peer.Read(make([]byte, 1)); err == nil {
+		t.Fatal("window update before half the window was read")
+	}
+	peer.SetReadDeadline(time.Time{})
+
+	for read < muxWindowSize/2 {
+		n, err := st.Read(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		read += n
+	}
+	f := readFrame(t, peer)
+	if f.typ != muxWindow || f.id != 1 || len(f.data) != 4 || int(binary.BigEndian.Uint32(f.data)) != read {
+		t.Fatalf("frame %d %d %v, want window of 1 by %d", f.typ, f.id, f.data, read)
+	}
+}
+
+func TestMuxStreamCap(t *testing.T) {
+	c, peer := net.Pipe()
+	s := newMuxSession(c, func(net.Conn) {}, time.Minute)
+	defer s.Close()
+	defer peer.Close()
+	for i := 0; i < muxMaxStreams; i++ {
+		if err := s.input(muxOpen, uint32(2*i+1), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	over := uint32(2*muxMaxStreams + 1)
+	if err := s.input(muxOpen, over, nil); err != nil {
+		t.Fatalf("open over the cap: %v, want a reset", err)
+	}
+	if f := readFrame(t, peer); f.typ != muxReset || f.id != over {
+		t.Errorf("sent frame %d %d, want reset of %d", f.typ, f.id, over)
+	}
+	if n := s.load(); n != muxMaxStreams {
+		t.Errorf("%d streams open, want %d", n, muxMaxStreams)
+	}
+
+	// The client side stops opening at the cap as well.
+	cc, cpeer := net.Pipe()
+	cs := newMuxSession(cc, nil, time.Minute)
+	defer cs.Close()
+	defer cpeer.Close()
+	go io.Copy(ioutil.Discard, cpeer)
+	for i := 0; i < muxMaxStreams; i++ {
+		if _, err := cs.open(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if st, err := cs.open(); err != errMuxFull {
+		t.Errorf("open over the cap = %v, %v, want %v", st, err, errMuxFull)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+const pacPath = "/proxy.pac"
+
+// pacTemplate walks the host suffixes exactly like ResloveMode. Hosts
+// without a rule still go through us so we pick direct or away for them.
+const pacTemplate = `var mode = %s;
+var proxy = %s;
+var rules = {%s
+};
+
+function FindProxyForURL(url, host) {
+	var m = mode;
+	if (m == "*") {
+		var s = host;
+		for (;;) {
+			if (rules.hasOwnProperty(s)) {
+				m = rules[s];
+				break;
+			}
+			var i = s.indexOf(".");
+			if (i < 0) {
+				break;
+			}
+			s = s.substring(i + 1);
+		}
+	}
+	switch (m) {
+	case "@":
+		return "DIRECT";
+	case "!":
+		return "PROXY 0.0.0.0:0";
+	default:
+		return proxy;
+	}
+}
+`
+
+// refreshPAC renders the rules for the PAC file, called on every change.
+func (a *Away) refreshPAC() {
+	var b bytes.Buffer
+	for i, r := range a.SortRules() {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "\n\t%s: %s", strconv.Quote(r[1:]), strconv.Quote(r[:1]))
+	}
+	a.pac.Store(b.String())
+}
+
+// PAC generates a proxy auto-config file sending traffic to proxy, with
+// mode as the current mode, zero meaning the mode of a.
+func (a *Away) PAC(mode rune, proxy string) string {
+	if mode == 0 {
+		mode = a.mode
+	}
+	m := strconv.Quote(string(mode))
+	p := strconv.Quote("SOCKS5 " + proxy + "; SOCKS " + proxy)
+	return fmt.Sprintf(pacTemplate, m, p, a.pac.Load().(string))
+}
+
+// pacProxy is where the PAC file sends traffic: the host and port the
+// client reached us by, or the listen address when those are not plain.
+func pacProxy(conn net.Conn, hostport string) string {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil || host == "" {
+		return conn.LocalAddr().String()
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return conn.LocalAddr().String()
+	}
+	if net.ParseIP(host) == nil {
+		for _, c := range host {
+			if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '.') {
+				return conn.LocalAddr().String()
+			}
+		}
+	}
+	return hostport
+}
+
+// servePAC answers req with the PAC file for the listener behind conn.
+func (s *SocksSrv) servePAC(conn net.Conn, req *http.Request, mode rune) error {
+	pac := s.away.PAC(mode, pacProxy(conn, req.Host))
+
+	resp := &http.Response{
+		StatusCode:    http.StatusOK,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"application/x-ns-proxy-autoconfig"}},
+		Body:          ioutil.NopCloser(bytes.NewBufferString(pac)),
+		ContentLength: int64(len(pac)),
+		Close:         req.Close,
+	}
+	return resp.Write(conn)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestAway(t *testing.T, mode rune, rules ...string) *Away {
+	a := NewAway(mode, "")
+	for _, r := range rules {
+		if err := a.AddRule(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return a
+}
+
+var pacRules = []string{"~google.com", "@cn", "!ads.example.com", "@example.com", "~mail.example.com"}
+
+var pacHosts = []string{
+	"google.com", "www.google.com", "google.com.cn", "baidu.cn", "cn",
+	"example.com", "www.example.com", "ads.example.com", "x.ads.example.com",
+	"mail.example.com", "example.org", "localhost", "192.0.2.1",
+}
+
+func TestPACRules(t *testing.T) {
+	a := newTestAway(t, ModeRule, pacRules...)
+	pac := a.PAC(0, "127.0.0.1:1080")
+
+	i, j := strings.Index(pac, "var rules = "), strings.Index(pac, "};")
+	if i < 0 || j < i {
+		t.Fatalf("no rules in PAC:\n%s", pac)
+	}
+	var rules map[string]string
+	if err := json.Unmarshal([]byte(pac[i+len("var rules = "):j+1]), &rules); err != nil {
+		t.Fatalf("rules of PAC: %v", err)
+	}
+	if len(rules) != len(pacRules) {
+		t.Errorf("PAC has %d rules, want %d", len(rules), len(pacRules))
+	}
+	for _, r := range pacRules {
+		if rules[r[1:]] != r[:1] {
+			t.Errorf("PAC rule %s = %q, want %q", r[1:], rules[r[1:]], r[:1])
+		}
+	}
+
+	a.DeleteRule("~google.com")
+	if strings.Contains(a.PAC(0, "127.0.0.1:1080"), `"google.com"`) {
+		t.Error("PAC keeps a deleted rule")
+	}
+	if !strings.Contains(a.PAC(ModeAway, "127.0.0.1:1080"), `var mode = "~";`) {
+		t.Error("PAC ignores the listener mode")
+	}
+}
+
+// TestPACMatchesResloveMode runs the PAC under node, when installed, and
+// checks it routes every host the way ResloveMode does.
+func TestPACMatchesResloveMode(t *testing.T) {
+	node, err := exec.LookPath("node")
+	if err != nil {
+		t.Skip("node not installed")
+	}
+	const proxy = "127.0.0.1:1080"
+	hosts, _ := json.Marshal(pacHosts)
+
+	for _, mode := range []rune{ModeRule, ModeAway, ModePass, ModeDrop} {
+		a := newTestAway(t, mode, pacRules...)
+		script := a.PAC(0, proxy) + "\n" + string(hosts) +
+			`.forEach(function(h) { console.log(FindProxyForURL("http://" + h + "/", h)); });`
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		out, err := exec.CommandContext(ctx, node, "-e", script).Output()
+		cancel()
+		if err != nil {
+			t.Fatalf("node: %v", err)
+		}
+		got := strings.Split(strings.TrimSpace(string(out)), "\n")
+		if len(got) != len(pacHosts) {
+			t.Fatalf("node printed %q", out)
+		}
+		for i, host := range pacHosts {
+			addr, _ := NewAddr("tcp", host+":80")
+			want := "SOCKS5 " + proxy + "; SOCKS " + proxy
+			switch a.ResloveMode(addr) {
+			case ModePass:
+				want = "DIRECT"
+			case ModeDrop:
+				want = "PROXY 0.0.0.0:0"
+			}
+			if got[i] != want {
+				t.Errorf("mode %c: PAC routes %s to %q, want %q", mode, host, got[i], want)
+			}
+		}
+	}
+}
+
+func TestPACProxy(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	local := conn.LocalAddr().String()
+
+	tests := []struct {
+		host string
+		want string
+	}{
+		{"127.0.0.1:1080", "127.0.0.1:1080"},
+		{"[::1]:1080", "[::1]:1080"},
+		{"proxy.lan:1080", "proxy.lan:1080"},
+		{"", local},
+		{"proxy.lan", local},
+		{":1080", local},
+		{"proxy.lan:http", local},
+		{"proxy.lan:70000", local},
+		{`a";alert(1);//:1080`, local},
+		{"a b:1080", local},
+	}
+	for _, tt := range tests {
+		if got := pacProxy(conn, tt.host); got != tt.want {
+			t.Errorf("pacProxy(%q) = %q, want %q", tt.host, got, tt.want)
+		}
+	}
+}
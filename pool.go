@@ -0,0 +1,142 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	poolMaxIdle = 30 * time.Second
+	poolRetry   = 5 * time.Second
+	poolCheck   = 5 * time.Millisecond
+)
+
+type pooledConn struct {
+	conn  net.Conn
+	since time.Time
+}
+
+// wsPool keeps up to size websockets to the remote open and idle, so that
+// tunnels start without a handshake. Idle ones are dropped after
+// poolMaxIdle, before proxies and NATs on the way forget them.
+type wsPool struct {
+	size int
+	dial func() (net.Conn, error)
+	stop <-chan struct{}
+	wake chan struct{}
+
+	mu   sync.Mutex
+	idle []pooledConn
+}
+
+func newWSPool(size int, dial func() (net.Conn, error), stop <-chan struct{}) *wsPool {
+	return &wsPool{
+		size: size,
+		dial: dial,
+		stop: stop,
+		wake: make(chan struct{}, 1),
+	}
+}
+
+// get takes the most recent idle websocket still alive, or returns nil
+// when none is left.
+func (p *wsPool) get() net.Conn {
+	defer p.refill()
+	for {
+		p.mu.Lock()
+		n := len(p.idle)
+		if n == 0 {
+			p.mu.Unlock()
+			return nil
+		}
+		pc := p.idle[n-1]
+		p.idle = p.idle[:n-1]
+		p.mu.Unlock()
+
+		if time.Since(pc.since) < poolMaxIdle && alive(pc.conn) {
+			return pc.conn
+		}
+		pc.conn.Close()
+	}
+}
+
+func (p *wsPool) refill() {
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run keeps the pool full and fresh until stopped.
+func (p *wsPool) run() {
+	defer p.close()
+	for {
+		wait := p.expire()
+		p.mu.Lock()
+		missing := p.size - len(p.idle)
+		p.mu.Unlock()
+
+		if missing > 0 {
+			conn, err := p.dial()
+			if err == nil {
+				p.mu.Lock()
+				p.idle = append(p.idle, pooledConn{conn, time.Now()})
+				p.mu.Unlock()
+				continue
+			}
+			log.Warn("Pool dial failure: ", err)
+			wait = poolRetry
+		}
+
+		select {
+		case <-p.stop:
+			return
+		case <-p.wake:
+		case <-time.After(wait):
+		}
+	}
+}
+
+// expire closes the websockets idle for too long and returns when the
+// next one expires.
+func (p *wsPool) expire() time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	i := 0
+	for ; i < len(p.idle) && time.Since(p.idle[i].since) >= poolMaxIdle; i++ {
+		p.idle[i].conn.Close()
+	}
+	p.idle = append(p.idle[:0], p.idle[i:]...)
+	if len(p.idle) == 0 {
+		return poolMaxIdle
+	}
+	return poolMaxIdle - time.Since(p.idle[0].since)
+}
+
+func (p *wsPool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, pc := range p.idle {
+		pc.conn.Close()
+	}
+	p.idle = nil
+}
+
+// alive tells whether the remote kept an idle websocket open: it sends
+// nothing before a request, so anything but a read timeout means the
+// websocket is closed or broken.
+func alive(conn net.Conn) bool {
+	if sc, ok := conn.(*SecConn); ok {
+		conn = sc.Conn
+	}
+	conn.SetReadDeadline(time.Now().Add(poolCheck))
+	_, err := conn.Read(make([]byte, 1))
+	if e, ok := err.(net.Error); !ok || !e.Timeout() {
+		return false
+	}
+	conn.SetReadDeadline(time.Time{})
+	return true
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// testIdle is an idle websocket of a pool, whose remote end may have gone.
+type testIdle struct {
+	age    time.Duration
+	closed bool
+}
+
+func newTestPool(t *testing.T, idle []testIdle) (*wsPool, []net.Conn) {
+	p := newWSPool(len(idle), nil, nil)
+	conns := make([]net.Conn, len(idle))
+	for i, ti := range idle {
+		c, rc := net.Pipe()
+		t.Cleanup(func() {
+			c.Close()
+			rc.Close()
+		})
+		if ti.closed {
+			rc.Close()
+		}
+		conns[i] = c
+		p.idle = append(p.idle, pooledConn{c, time.Now().Add(-ti.age)})
+	}
+	return p, conns
+}
+
+func TestPoolGet(t *testing.T) {
+	tests := []struct {
+		name string
+		idle []testIdle
+		want int // index of the websocket got, -1 for none
+		left int
+	}{
+		{"empty", nil, -1, 0},
+		{"most recent", []testIdle{{2 * time.Second, false}, {time.Second, false}}, 1, 1},
+		{"skip closed", []testIdle{{2 * time.Second, false}, {time.Second, true}}, 0, 0},
+		{"skip expired", []testIdle{{poolMaxIdle, false}}, -1, 0},
+		{"none alive", []testIdle{{time.Second, true}, {poolMaxIdle + time.Second, false}}, -1, 0},
+	}
+	for _, tt := range tests {
+		p, conns := newTestPool(t, tt.idle)
+		got := p.get()
+		switch {
+		case tt.want < 0 && got != nil:
+			t.Errorf("%s: got a websocket, want none", tt.name)
+		case tt.want >= 0 && got != conns[tt.want]:
+			t.Errorf("%s: got %v, want websocket %d", tt.name, got, tt.want)
+		}
+		if len(p.idle) != tt.left {
+			t.Errorf("%s: %d idle left, want %d", tt.name, len(p.idle), tt.left)
+		}
+	}
+}
+
+func TestPoolExpire(t *testing.T) {
+	tests := []struct {
+		name string
+		ages []time.Duration
+		left int
+		wait time.Duration // at most
+	}{
+		{"empty", nil, 0, poolMaxIdle},
+		{"fresh", []time.Duration{10 * time.Second, time.Second}, 2, poolMaxIdle - 10*time.Second},
+		{"expired", []time.Duration{poolMaxIdle + time.Second, poolMaxIdle}, 0, poolMaxIdle},
+		{"some expired", []time.Duration{poolMaxIdle, 20 * time.Second, time.Second}, 2, poolMaxIdle - 20*time.Second},
+	}
+	for _, tt := range tests {
+		idle := make([]testIdle, len(tt.ages))
+		for i, age := range tt.ages {
+			idle[i].age = age
+		}
+		p, conns := newTestPool(t, idle)
+		wait := p.expire()
+		if len(p.idle) != tt.left {
+			t.Errorf("%s: %d idle left, want %d", tt.name, len(p.idle), tt.left)
+		}
+		if wait > tt.wait || wait < tt.wait-time.Second {
+			t.Errorf("%s: next expiry in %s, want %s", tt.name, wait, tt.wait)
+		}
+		for _, c := range conns[:len(conns)-tt.left] {
+			if _, err := c.Write([]byte{0}); err == nil {
+				t.Errorf("%s: expired websocket still open", tt.name)
+			}
+		}
+	}
+}
+
+func TestAlive(t *testing.T) {
+	tests := []struct {
+		name string
+		peer func(net.Conn)
+		want bool
+	}{
+		{"idle", func(net.Conn) {}, true},
+		{"closed", func(rc net.Conn) { rc.Close() }, false},
+		{"unexpected data", func(rc net.Conn) { go rc.Write([]byte{0}) }, false},
+	}
+	for _, tt := range tests {
+		c, rc := net.Pipe()
+		tt.peer(rc)
+		if got := alive(c); got != tt.want {
+			t.Errorf("%s: alive = %v, want %v", tt.name, got, tt.want)
+		}
+		if tt.want {
+			// The deadline of the check is cleared
+			time.Sleep(2 * poolCheck)
+			go rc.Write([]byte{1})
+			if _, err := c.Read(make([]byte, 1)); err != nil {
+				t.Errorf("%s: read after check: %v", tt.name, err)
+			}
+		}
+		c.Close()
+		rc.Close()
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// serveRedir accepts connections redirected by iptables REDIRECT and
+// routes them to their original destination.
+func (s *SocksSrv) serveRedir() {
+	l := s.redir
+
+	log.Infof("Redir %s %c", l.Addr(), s.away.Mode())
+
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			select {
+			case <-s.stop:
+				return
+			default:
+				log.Warn("Accepting connection failure: ", err)
+				continue
+			}
+		}
+
+		if !s.acl.allowed(c.RemoteAddr()) {
+			c.Close()
+			continue
+		}
+		ip := connIP(c.RemoteAddr())
+		if err := s.limits.acquire(ip); err != nil {
+			s.limits.reject(c.RemoteAddr(), err)
+			c.Close()
+			continue
+		}
+
+		go func(c net.Conn) {
+			defer func() {
+				c.Close()
+				s.limits.release(ip)
+			}()
+
+			keepAlive(c)
+
+			addr, err := originalDst(c.(*net.TCPConn))
+			if err != nil {
+				log.Warn("Original destination failure: ", err)
+				return
+			}
+			if addr.String() == c.LocalAddr().String() { // not redirected, avoid looping
+				log.Warnf("Redir %s->%s is not redirected", c.RemoteAddr().String(), addr.String())
+				return
+			}
+
+			addr = s.realAddr(addr)
+			s.route(c, addr, s.away.ResloveMode(addr), nil)
+		}(c)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// SO_ORIGINAL_DST and IP6T_SO_ORIGINAL_DST from linux/netfilter_ipv4.h and
+// linux/netfilter_ipv6/ip6_tables.h
+const soOriginalDst = 80
+
+// originalDst returns the destination of conn before it was redirected by
+// iptables REDIRECT.
+func originalDst(conn *net.TCPConn) (*Addr, error) {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	ipv4 := conn.LocalAddr().(*net.TCPAddr).IP.To4() != nil
+	var addr *Addr
+	var serr error
+	err = rc.Control(func(fd uintptr) {
+		if ipv4 {
+			var mreq *unix.IPv6Mreq // same size as sockaddr_in
+			if mreq, serr = unix.GetsockoptIPv6Mreq(int(fd), unix.IPPROTO_IP, soOriginalDst); serr != nil {
+				return
+			}
+			addr = origDst4(mreq.Multiaddr[:])
+		} else {
+			var info *unix.IPv6MTUInfo // starts with sockaddr_in6
+			if info, serr = unix.GetsockoptIPv6MTUInfo(int(fd), unix.IPPROTO_IPV6, soOriginalDst); serr != nil {
+				return
+			}
+			addr = origDst6(&info.Addr)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if serr != nil {
+		return nil, serr
+	}
+	return addr, nil
+}
+
+// origDst4 decodes a sockaddr_in, its port and address in network byte order.
+func origDst4(sa []byte) *Addr {
+	a := append([]byte{atypIPv4}, sa[4:8]...)
+	return &Addr{network: "tcp", addr: append(a, sa[2:4]...)}
+}
+
+// origDst6 decodes a sockaddr_in6, its port in network byte order.
+func origDst6(sa *unix.RawSockaddrInet6) *Addr {
+	port := (*[2]byte)(unsafe.Pointer(&sa.Port))
+	a := append([]byte{atypIPv6}, sa.Addr[:]...)
+	return &Addr{network: "tcp", addr: append(a, port[:]...)}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestOrigDst4(t *testing.T) {
+	tests := []struct {
+		sa   []byte
+		want string
+	}{
+		{[]byte{2, 0, 0x1f, 0x90, 192, 0, 2, 1, 0, 0, 0, 0, 0, 0, 0, 0}, "192.0.2.1:8080"},
+		{[]byte{2, 0, 0, 80, 10, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0}, "10.0.0.1:80"},
+		{[]byte{2, 0, 0xff, 0xff, 255, 255, 255, 255, 0, 0, 0, 0, 0, 0, 0, 0}, "255.255.255.255:65535"},
+	}
+	for _, tt := range tests {
+		if got := origDst4(tt.sa); got.String() != tt.want || got.Network() != "tcp" {
+			t.Errorf("origDst4(%v) = %s, want %s", tt.sa, got, tt.want)
+		}
+	}
+}
+
+func TestOrigDst6(t *testing.T) {
+	tests := []struct {
+		ip   string
+		port [2]byte // network byte order
+		want string
+	}{
+		{"2001:db8::1", [2]byte{0x01, 0xbb}, "[2001:db8::1]:443"},
+		{"::1", [2]byte{0, 80}, "[::1]:80"},
+		{"fe80::1:2", [2]byte{0x1f, 0x90}, "[fe80::1:2]:8080"},
+	}
+	for _, tt := range tests {
+		var sa unix.RawSockaddrInet6
+		copy(sa.Addr[:], net.ParseIP(tt.ip))
+		*(*[2]byte)(unsafe.Pointer(&sa.Port)) = tt.port
+		if got := origDst6(&sa); got.String() != tt.want {
+			t.Errorf("origDst6(%s) = %s, want %s", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestOriginalDstNotRedirected(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	ac, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ac.Close()
+
+	if addr, err := originalDst(ac.(*net.TCPConn)); err == nil && addr.String() != l.Addr().String() {
+		t.Errorf("originalDst of a connection not redirected = %s", addr)
+	}
+}
@@ -0,0 +1,12 @@
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+func originalDst(conn *net.TCPConn) (*Addr, error) {
+	return nil, errors.New("transparent proxy is only supported on linux")
+}
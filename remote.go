@@ -1,61 +1,230 @@
 package main
 
 import (
+	"crypto/subtle"
+	"crypto/tls"
 	"html/template"
+	"io"
 	"net"
 	"net/http"
+	"time"
 
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 	"golang.org/x/net/websocket"
 )
 
+const dialTimeout = 10 * time.Second
+
 func Remote(s *Settings) {
-	sec, err := NewSecurity(s.Passkey)
+	var err error
+	var sec *Security
+	if s.Passkey != "" || s.ClientCA == "" {
+		if sec, err = NewSecurity(s.Passkey); err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		log.Info("Tunnels secured by client certificates, without passkey")
+	}
+
+	hub, err := newReverseHub(s.ReversePorts)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	srv := &http.Server{
-		Addr: ":" + s.Port,
+	resolver := resolverAddr(s.Resolver)
+
+	var certs *certStore
+	if s.Cert != "" || s.Key != "" || s.ClientCA != "" {
+		if certs, err = loadCertStore(s.Cert, s.Key, s.ClientCA, s.CRL); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if err := checkNoMode(s.Listen); err != nil {
+		log.Fatal(err)
+	}
+	ls, err := listenAll(s, "")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(ls) == 0 {
+		log.Fatal("Remote start failure: no listen address")
+	}
+	// h2c serves HTTP/2 without TLS along HTTP/1 and websockets
+	srv := &http.Server{Handler: h2c.NewHandler(http.DefaultServeMux, &http2.Server{})}
+	if err := http2.ConfigureServer(srv, &http2.Server{}); err != nil {
+		log.Fatal(err)
 	}
 
 	fs := http.FileServer(http.Dir("asset"))
 	http.Handle("/static/", fs)
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+	site := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		tmpl := template.Must(template.ParseFiles("asset/index.html"))
 		tmpl.Execute(w, nil)
 	})
-	http.Handle("/_a", websocket.Handler(secureHandler(sec)))
+	http.Handle("/", site)
+	h := &tunnelHandler{hub: hub, resolver: resolver}
+	ws := http.Handler(websocket.Handler(secureHandler(sec, h)))
+	h2 := http.Handler(h2Handler(sec, h))
+	if s.Token != "" {
+		if ws, err = tokenHandler(s.Token, ws, site); err != nil {
+			log.Fatal(err)
+		}
+		h2, _ = tokenHandler(s.Token, h2, site)
+	}
+	http.Handle(wsPathOf(s), ws)
+	http.Handle(h2Path, h2)
+
+	serveStream := func(c net.Conn) {
+		if s.Token != "" { // streams carry no header to check
+			c.Close()
+			return
+		}
+		var wss net.Conn = sec.secure(c)
+		defer wss.Close()
+		if fc, ok := c.(*frameConn); ok {
+			if tc, ok := fc.Conn.(*tls.Conn); ok {
+				state := tc.ConnectionState()
+				wss = withCertUser(wss, &state)
+			}
+		}
+
+		var ip net.IP
+		if a, ok := c.LocalAddr().(*net.TCPAddr); ok {
+			ip = a.IP
+		}
+		h.serve(wss, ip, false)
+	}
+	nls := make([]net.Listener, len(ls))
+	for i, l := range ls {
+		nls[i] = l
+		if certs != nil {
+			nls[i] = tls.NewListener(l, certs.tlsConfig())
+		}
+	}
+	for _, l := range nls[1:] {
+		go serveRemote(srv, newSplitListener(l, serveStream))
+	}
+	serveRemote(srv, newSplitListener(nls[0], serveStream))
+}
 
-	log.Info("Remote start on: ", srv.Addr)
-	log.Fatal("Remote start failure: ", srv.ListenAndServe())
+func serveRemote(srv *http.Server, l net.Listener) {
+	log.Info("Remote start on: ", l.Addr())
+	log.Fatal("Remote start failure: ", srv.Serve(l))
 }
 
-func secureHandler(sec *Security) func(*websocket.Conn) {
+// tokenHandler serves h the requests carrying the "Name: value" header
+// of token, and the others the site, as if h wasn't there.
+func tokenHandler(token string, h, site http.Handler) (http.Handler, error) {
+	name, value, err := parseHeader(token)
+	if err != nil {
+		return nil, err
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get(name)), []byte(value)) != 1 {
+			site.ServeHTTP(w, r)
+			return
+		}
+		h.ServeHTTP(w, r)
+	}), nil
+}
+
+func secureHandler(sec *Security, h *tunnelHandler) func(*websocket.Conn) {
 	return func(ws *websocket.Conn) {
-		wss := sec.secure(ws)
+		var wss net.Conn = sec.secure(ws)
 		defer wss.Close()
+		wss = withCertUser(wss, ws.Request().TLS)
 
-		addr, err := ReadAddr(wss, "tcp")
-		if err != nil {
-			log.Warn("Addr read failure: ", err)
-			return
+		var ip net.IP
+		if a, ok := ws.Request().Context().Value(http.LocalAddrContextKey).(*net.TCPAddr); ok {
+			ip = a.IP
 		}
+		h.serve(wss, ip, false)
+	}
+}
+
+// tunnelHandler serves the requests of tunnels, whether websockets or
+// streams of a mux session.
+type tunnelHandler struct {
+	hub      *reverseHub
+	resolver string
+}
 
-		// Relay to target
-		tc, err := net.Dial(addr.Network(), addr.String())
-		if err != nil {
-			log.Warn("Target dial failure: ", err)
+// serve serves the request on wss, ip being the local address the client
+// reached. wss is a userConn when the client presented a certificate.
+func (h *tunnelHandler) serve(wss net.Conn, ip net.IP, muxed bool) {
+	cmd, addr, err := readRequest(wss)
+	if err == io.EOF { // pooled by the client, closed unused
+		return
+	}
+	if err != nil {
+		log.Warn("Addr read failure: ", err)
+		return
+	}
+
+	switch cmd {
+	case cmdConnect, cmdLegacy:
+	case cmdBind:
+		relayBind(wss, ip)
+		return
+	case cmdUdp:
+		relayUDP(wss)
+		return
+	case cmdReverse:
+		h.hub.serve(wss, addr)
+		return
+	case cmdAccept:
+		h.hub.accept(wss, addr)
+		return
+	case cmdDNS:
+		relayDNS(wss, h.resolver)
+		return
+	case cmdMux:
+		if muxed {
+			reply(wss, repCmdNotSupported, nil)
+			return
+		}
+		if _, err := reply(wss, repSucceeded, nil); err != nil {
 			return
 		}
-		defer tc.Close()
+		serveMux(wss, func(c net.Conn) {
+			defer c.Close()
+			if uc, ok := wss.(*userConn); ok {
+				c = &userConn{c, uc.user}
+			}
+			h.serve(c, ip, true)
+		})
+		return
+	default:
+		reply(wss, repCmdNotSupported, nil)
+		return
+	}
 
-		tc.(*net.TCPConn).SetKeepAlive(true)
-		if nout, nin, err := relay(tc, wss); err != nil {
-			log.Warn("Relay target failure: ", err)
+	// Relay to target
+	tc, err := net.DialTimeout(addr.Network(), addr.String(), dialTimeout)
+	if cmd == cmdConnect {
+		var bnd *Addr
+		if err == nil {
+			bnd, _ = NewAddr("tcp", tc.LocalAddr().String())
+		}
+		if _, e := reply(wss, repCode(err), bnd); e != nil && err == nil {
+			tc.Close()
 			return
-		} else {
-			log.Infof("Away: %s ~ %s <%d %d>", wss.RemoteAddr(), addr.String(), nin, nout)
 		}
 	}
+	if err != nil {
+		log.Warn("Target dial failure: ", err)
+		return
+	}
+	defer tc.Close()
+
+	tc.(*net.TCPConn).SetKeepAlive(true)
+	if nout, nin, err := relay(tc, wss); err != nil {
+		log.Warn("Relay target failure: ", err)
+		return
+	} else {
+		log.Infof("Away: %s ~ %s <%d %d>", clientName(wss), addr.String(), nin, nout)
+	}
 }
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Reverse tunnels let the remote listen on behalf of the local side. The
+// local registers with a REVERSE request, then the remote notifies each
+// inbound connection on that tunnel as
+// +----+------+----------+----------+
+// | ID | ATYP | SRC.ADDR | SRC.PORT |
+// +----+------+----------+----------+
+// | 8  |  1   | Variable |    2     |
+// +----+------+----------+----------+
+// and the local claims it with an ACCEPT request followed by the ID.
+// IDs are random and only claimed by the user who registered, ID 0 being
+// a heartbeat.
+
+const (
+	reverseHeartbeat = 30 * time.Second
+	reverseTimeout   = 10 * time.Second
+)
+
+// reverse exposes target on the remote at addr.
+type reverse struct {
+	addr   *Addr
+	target *Addr
+}
+
+// parseReverse parses a reverse given as "remote-listen=host:port",
+// eg: "0.0.0.0:2222=127.0.0.1:22".
+func parseReverse(spec string) (*reverse, error) {
+	i := strings.LastIndex(spec, "=")
+	if i < 0 {
+		return nil, fmt.Errorf("Invalid reverse %s, want listen=host:port", spec)
+	}
+	addr, err := NewAddr("tcp", spec[:i])
+	if err != nil {
+		return nil, fmt.Errorf("Invalid reverse %s, %s", spec, err)
+	}
+	target, err := NewAddr("tcp", spec[i+1:])
+	if err != nil {
+		return nil, fmt.Errorf("Invalid reverse %s, %s", spec, err)
+	}
+	return &reverse{addr: addr, target: target}, nil
+}
+
+// serveReverse keeps r registered on the remote until the server stops.
+func (s *SocksSrv) serveReverse(r *reverse) {
+	backoff := time.Second
+	for {
+		registered, err := s.registerReverse(r)
+		if registered {
+			backoff = time.Second
+		}
+		select {
+		case <-s.stop:
+			return
+		default:
+			log.Warnf("Reverse %s failure: %s", r.addr.String(), err)
+		}
+
+		select {
+		case <-s.stop:
+			return
+		case <-time.After(backoff):
+		}
+		if backoff < time.Minute {
+			backoff *= 2
+		}
+	}
+}
+
+func (s *SocksSrv) registerReverse(r *reverse) (bool, error) {
+	ac, bnd, err := s.dialTunnel(cmdReverse, r.addr)
+	if err != nil {
+		return false, err
+	}
+	defer ac.Close()
+
+	log.Infof("Reverse %s ~ %s", bnd.String(), r.target.String())
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-s.stop:
+			ac.Close()
+		case <-done:
+		}
+	}()
+
+	buf := make([]byte, 8)
+	for {
+		// Heartbeats stopping tell a half-open tunnel to register again
+		ac.SetReadDeadline(time.Now().Add(3 * reverseHeartbeat))
+		if _, err := io.ReadFull(ac, buf); err != nil {
+			return true, err
+		}
+		peer, err := ReadAddr(ac, "tcp")
+		if err != nil {
+			return true, err
+		}
+		if id := binary.BigEndian.Uint64(buf); id != 0 {
+			go s.acceptReverse(r, id, peer)
+		}
+	}
+}
+
+func (s *SocksSrv) acceptReverse(r *reverse, id uint64, peer *Addr) {
+	tc, err := net.DialTimeout("tcp", r.target.String(), dialTimeout)
+	if err != nil {
+		log.Warnf("Reverse %s->%s failure: %s", peer.String(), r.target.String(), err)
+		return
+	}
+	defer tc.Close()
+
+	ac, err := s.openTunnel(cmdAccept, peer)
+	if err != nil {
+		log.Warnf("Reverse %s->%s failure: %s", peer.String(), r.target.String(), err)
+		return
+	}
+	defer ac.Close()
+
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], id)
+	if _, err := ac.Write(b[:]); err != nil {
+		return
+	}
+	if _, err := readReply(ac, "tcp"); err != nil {
+		log.Warnf("Reverse %s->%s failure: %s", peer.String(), r.target.String(), err)
+		return
+	}
+
+	keepAlive(tc)
+	nout, nin, err := relay(tc, ac)
+	if err != nil {
+		log.Warn("Relay reverse failure: ", err)
+	}
+	log.Infof("Reverse %s->%s <%d %d>", peer.String(), r.target.String(), nin, nout)
+}
+
+// reverseHub holds the reverse listeners of the remote and the inbound
+// connections waiting to be claimed.
+type reverseHub struct {
+	ports []portRange
+
+	mu      sync.Mutex
+	pending map[uint64]parked
+}
+
+// portRange allows reverse listeners on ports lo to hi, to user only when
+// given.
+type portRange struct {
+	user   string
+	lo, hi int
+}
+
+// parked is an inbound connection waiting to be claimed by the user who
+// registered its listener.
+type parked struct {
+	conn net.Conn
+	user string
+}
+
+// newReverseHub allows reverse listeners on ports, given as single ports
+// or ranges, optionally for a certificate user only, eg: "2222",
+// "8000-8100", "alice=2223".
+func newReverseHub(ports []string) (*reverseHub, error) {
+	h := &reverseHub{pending: make(map[uint64]parked)}
+	for _, p := range ports {
+		var user string
+		spec := p
+		if i := strings.IndexRune(spec, '='); i >= 0 {
+			user, spec = spec[:i], spec[i+1:]
+		}
+		lo, hi := spec, spec
+		if i := strings.IndexRune(spec, '-'); i >= 0 {
+			lo, hi = spec[:i], spec[i+1:]
+		}
+		l, err := strconv.ParseUint(lo, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid reverse port %s", p)
+		}
+		u, err := strconv.ParseUint(hi, 10, 16)
+		if err != nil || u < l {
+			return nil, fmt.Errorf("Invalid reverse port %s", p)
+		}
+		h.ports = append(h.ports, portRange{user, int(l), int(u)})
+	}
+	return h, nil
+}
+
+// allowed tells whether user may listen on port.
+func (h *reverseHub) allowed(port int, user string) bool {
+	for _, r := range h.ports {
+		if port >= r.lo && port <= r.hi && (r.user == "" || r.user == user) {
+			return true
+		}
+	}
+	return false
+}
+
+// serve listens on addr for the local side behind wss.
+func (h *reverseHub) serve(wss net.Conn, addr *Addr) {
+	if !h.allowed(addr.Port(), connUser(wss)) {
+		log.Warnf("Reverse %s ~ %s is not allowed", clientName(wss), addr.String())
+		reply(wss, repNotAllowed, nil)
+		return
+	}
+	l, err := net.Listen("tcp", addr.String())
+	if err != nil {
+		log.Warn("Reverse listen failure: ", err)
+		reply(wss, repCode(err), nil)
+		return
+	}
+	defer l.Close()
+
+	bnd, err := NewAddr("tcp", l.Addr().String())
+	if err != nil {
+		reply(wss, repGeneralFailure, nil)
+		return
+	}
+	if _, err := reply(wss, repSucceeded, bnd); err != nil {
+		return
+	}
+	log.Infof("Reverse %s ~ %s", clientName(wss), bnd.String())
+
+	var mu sync.Mutex
+	notify := func(id uint64, peer *Addr) error {
+		b := make([]byte, 8, 8+len(peer.addr))
+		binary.BigEndian.PutUint64(b, id)
+		mu.Lock()
+		defer mu.Unlock()
+		_, err := wss.Write(append(b, peer.addr...))
+		return err
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		io.Copy(ioutil.Discard, wss)
+		l.Close()
+	}()
+	go func() {
+		t := time.NewTicker(reverseHeartbeat)
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+				if err := notify(0, zeroAddr); err != nil {
+					l.Close()
+					return
+				}
+			}
+		}
+	}()
+
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			log.Infof("Reverse %s ~ %s closed", clientName(wss), bnd.String())
+			return
+		}
+		peer, err := NewAddr("tcp", c.RemoteAddr().String())
+		if err != nil {
+			c.Close()
+			continue
+		}
+		id := h.park(c, connUser(wss))
+		if err := notify(id, peer); err != nil {
+			if c := h.take(id, connUser(wss)); c != nil {
+				c.Close()
+			}
+			return
+		}
+	}
+}
+
+// park keeps c for user until claimed or timed out, under a random ID
+// that other clients can't guess.
+func (h *reverseHub) park(c net.Conn, user string) uint64 {
+	var b [8]byte
+	h.mu.Lock()
+	var id uint64
+	for {
+		rand.Read(b[:])
+		id = binary.BigEndian.Uint64(b[:])
+		if _, ok := h.pending[id]; id != 0 && !ok {
+			break
+		}
+	}
+	h.pending[id] = parked{c, user}
+	h.mu.Unlock()
+
+	time.AfterFunc(reverseTimeout, func() {
+		if c := h.take(id, user); c != nil {
+			c.Close()
+		}
+	})
+	return id
+}
+
+// take claims the connection parked under id for user.
+func (h *reverseHub) take(id uint64, user string) net.Conn {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	p, ok := h.pending[id]
+	if !ok || p.user != user {
+		return nil
+	}
+	delete(h.pending, id)
+	return p.conn
+}
+
+// accept relays a parked connection to the local side behind wss.
+func (h *reverseHub) accept(wss net.Conn, peer *Addr) {
+	var b [8]byte
+	if _, err := io.ReadFull(wss, b[:]); err != nil {
+		return
+	}
+	c := h.take(binary.BigEndian.Uint64(b[:]), connUser(wss))
+	if c == nil {
+		reply(wss, repGeneralFailure, nil)
+		return
+	}
+	defer c.Close()
+
+	if _, err := reply(wss, repSucceeded, peer); err != nil {
+		return
+	}
+	keepAlive(c)
+	if nout, nin, err := relay(c, wss); err != nil {
+		log.Warn("Relay reverse failure: ", err)
+	} else {
+		log.Infof("Reverse: %s ~ %s <%d %d>", clientName(wss), peer.String(), nin, nout)
+	}
+}
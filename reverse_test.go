@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestReverseHubTake(t *testing.T) {
+	h, err := newReverseHub(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	id := h.park(c1, "alice")
+	if other := h.park(c2, "alice"); other == id || id == 0 || other == 0 {
+		t.Fatalf("park IDs %d and %d, want distinct and nonzero", id, other)
+	}
+	if c := h.take(id, "bob"); c != nil {
+		t.Fatal("take by another user succeeded")
+	}
+	if c := h.take(id+1, "alice"); c != nil {
+		t.Fatal("take of an unknown ID succeeded")
+	}
+	if c := h.take(id, "alice"); c != c1 {
+		t.Fatal("take by the registering user failed")
+	}
+	if c := h.take(id, "alice"); c != nil {
+		t.Fatal("take succeeded twice")
+	}
+}
+
+func TestReverseHubAllowed(t *testing.T) {
+	h, err := newReverseHub([]string{"2222", "8000-8100", "alice=2223", "bob=9000-9001"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		port int
+		user string
+		want bool
+	}{
+		{2222, "", true},
+		{2222, "bob", true},
+		{8050, "", true},
+		{8101, "", false},
+		{2223, "alice", true},
+		{2223, "bob", false},
+		{2223, "", false},
+		{9001, "bob", true},
+		{9001, "alice", false},
+	}
+	for _, tt := range tests {
+		if got := h.allowed(tt.port, tt.user); got != tt.want {
+			t.Errorf("allowed(%d, %q) = %v, want %v", tt.port, tt.user, got, tt.want)
+		}
+	}
+
+	for _, bad := range []string{"x", "10-5", "alice=", "70000", "alice=1-x"} {
+		if _, err := newReverseHub([]string{bad}); err == nil {
+			t.Errorf("newReverseHub(%q) succeeded", bad)
+		}
+	}
+}
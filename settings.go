@@ -9,9 +9,44 @@ import (
 )
 
 type Settings struct {
-	Remote  string
-	Passkey string
-	Port    string
+	Remote     string
+	Passkey    string
+	Port       string
+	Users      string
+	RedirPort  string
+	TProxyPort string
+	Listen     []string
+	Forwards   []string
+	Reverses   []string
+	DNS        string
+	Resolver   string
+	FakeIP     string
+	Sniff      bool
+	Allow      []string
+	Deny       []string
+	Tun        string
+	RemoteCA   string
+	Pins       []string
+	Cert       string
+	Key        string
+	ClientCA   string
+	CRL        string
+	ClientCert string
+	ClientKey  string
+	WSPath     string
+	HostHeader string
+	SNI        string
+	UserAgent  string
+	Headers    []string
+	Token      string
+	Mux        int
+	Pool       int
+
+	HandshakeTimeout time.Duration
+	MaxConns         int
+	MaxConnsPerIP    int
+
+	ReversePorts []string
 }
 
 func ExistSetting(filename string) bool {
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	sniffTimeout = 300 * time.Millisecond
+	sniffBufSize = 5 + 16*1024 // a whole TLS record
+)
+
+// sniff peeks at the first bytes the client sends to addr for the TLS SNI
+// or the HTTP Host, and returns the domain address found with conn
+// replaying the peeked bytes. Clients waiting for the server to speak
+// first only cost sniffTimeout.
+func sniff(conn net.Conn, addr *Addr) (net.Conn, *Addr) {
+	bc := &bufConn{conn, bufio.NewReaderSize(conn, sniffBufSize)}
+	conn.SetReadDeadline(time.Now().Add(sniffTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	b, err := bc.r.Peek(1)
+	if err != nil {
+		return bc, addr
+	}
+	var host string
+	if b[0] == 0x16 { // TLS handshake
+		host = sniffSNI(bc.r)
+	} else {
+		host = sniffHost(bc.r)
+	}
+	if host == "" {
+		return bc, addr
+	}
+
+	a, err := NewAddr(addr.network, net.JoinHostPort(host, strconv.Itoa(addr.Port())))
+	if err != nil || a.addr[0] != atypDomainName {
+		return bc, addr
+	}
+	return bc, a
+}
+
+// sniffSNI reads the server name of a ClientHello sent in a single record.
+// https://tools.ietf.org/html/rfc8446#section-4.1.2
+func sniffSNI(r *bufio.Reader) string {
+	h, err := r.Peek(5)
+	if err != nil {
+		return ""
+	}
+	b, err := r.Peek(5 + int(binary.BigEndian.Uint16(h[3:5])))
+	if err != nil {
+		return ""
+	}
+	b = b[5:]
+
+	// Handshake type, length, version, random
+	if len(b) < 38 || b[0] != 1 {
+		return ""
+	}
+	b = b[38:]
+	// Session id, cipher suites, compression methods
+	for _, l := range []int{1, 2, 1} {
+		if len(b) < l {
+			return ""
+		}
+		n := int(b[0])
+		if l == 2 {
+			n = int(binary.BigEndian.Uint16(b))
+		}
+		if len(b) < l+n {
+			return ""
+		}
+		b = b[l+n:]
+	}
+	// Extensions
+	if len(b) < 2 {
+		return ""
+	}
+	b = b[2:]
+	for len(b) >= 4 {
+		typ := binary.BigEndian.Uint16(b)
+		n := int(binary.BigEndian.Uint16(b[2:]))
+		if len(b) < 4+n {
+			return ""
+		}
+		ext := b[4 : 4+n]
+		b = b[4+n:]
+		if typ != 0 { // server_name
+			continue
+		}
+		// Server name list of type, length, name
+		if len(ext) < 2 {
+			return ""
+		}
+		ext = ext[2:]
+		for len(ext) >= 3 {
+			n := int(binary.BigEndian.Uint16(ext[1:]))
+			if len(ext) < 3+n {
+				return ""
+			}
+			if ext[0] == 0 { // host_name
+				return string(ext[3 : 3+n])
+			}
+			ext = ext[3+n:]
+		}
+		return ""
+	}
+	return ""
+}
+
+// sniffHost reads the Host header of an HTTP request.
+func sniffHost(r *bufio.Reader) string {
+	b, _ := r.Peek(r.Buffered())
+	for !bytes.Contains(b, []byte("\r\n\r\n")) {
+		if i := bytes.Index(b, []byte("\r\n")); i >= 0 && !bytes.Contains(b[:i], []byte(" HTTP/1.")) {
+			return "" // not HTTP
+		}
+		var err error
+		if b, err = r.Peek(len(b) + 1); err != nil {
+			b, _ = r.Peek(r.Buffered())
+			break
+		}
+	}
+
+	lines := strings.Split(string(b), "\r\n")
+	if len(lines) < 2 || !strings.Contains(lines[0], " HTTP/1.") {
+		return ""
+	}
+	for _, l := range lines[1:] {
+		if l == "" {
+			break
+		}
+		if i := strings.IndexByte(l, ':'); i > 0 && strings.EqualFold(l[:i], "Host") {
+			host := strings.TrimSpace(l[i+1:])
+			if h, _, err := net.SplitHostPort(host); err == nil {
+				host = h
+			}
+			return host
+		}
+	}
+	return ""
+}
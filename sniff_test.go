@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// clientHello returns the first record of a TLS handshake to name.
+func clientHello(t *testing.T, name string) []byte {
+	c, s := net.Pipe()
+	defer s.Close()
+	go tls.Client(c, &tls.Config{ServerName: name, InsecureSkipVerify: true}).Handshake()
+
+	h := make([]byte, 5)
+	if _, err := io.ReadFull(s, h); err != nil {
+		t.Fatal(err)
+	}
+	rec := make([]byte, 5+int(binary.BigEndian.Uint16(h[3:5])))
+	copy(rec, h)
+	if _, err := io.ReadFull(s, rec[5:]); err != nil {
+		t.Fatal(err)
+	}
+	return rec
+}
+
+func TestSniffSNI(t *testing.T) {
+	hello := clientHello(t, "example.com")
+	tests := []struct {
+		name string
+		b    []byte
+		want string
+	}{
+		{"sni", hello, "example.com"},
+		{"sni trailing", append(append([]byte{}, hello...), "more"...), "example.com"},
+		{"long sni", clientHello(t, strings.Repeat("a", 60)+".example.com"), strings.Repeat("a", 60) + ".example.com"},
+		{"no sni", clientHello(t, "192.0.2.1"), ""},
+		{"truncated record", hello[:len(hello)-1], ""},
+		{"header only", hello[:5], ""},
+		{"not client hello", append([]byte{0x16, 3, 1, 0, 4, 2}, 0, 0, 0), ""},
+		{"empty record", []byte{0x16, 3, 1, 0, 0}, ""},
+	}
+	for _, tt := range tests {
+		if got := sniffSNI(bufio.NewReaderSize(bytes.NewReader(tt.b), sniffBufSize)); got != tt.want {
+			t.Errorf("%s: sniffSNI = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	// Every cut of the record inside its length fails cleanly
+	for i := 5; i < len(hello); i++ {
+		b := append([]byte{}, hello[:i]...)
+		binary.BigEndian.PutUint16(b[3:5], uint16(i-5))
+		if got := sniffSNI(bufio.NewReaderSize(bytes.NewReader(b), sniffBufSize)); got != "" && got != "example.com" {
+			t.Fatalf("sniffSNI of %d bytes = %q", i, got)
+		}
+	}
+}
+
+func TestSniffHost(t *testing.T) {
+	tests := []struct {
+		name string
+		req  string
+		want string
+	}{
+		{"host", "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n", "example.com"},
+		{"host port", "GET / HTTP/1.1\r\nHost: example.com:8080\r\n\r\n", "example.com"},
+		{"ipv6", "GET / HTTP/1.1\r\nHost: [2001:db8::1]:80\r\n\r\n", "2001:db8::1"},
+		{"case", "POST /x HTTP/1.0\r\nUser-Agent: t\r\nhOsT:  example.org \r\n\r\nbody", "example.org"},
+		{"no host", "GET / HTTP/1.1\r\nAccept: */*\r\n\r\n", ""},
+		{"host in body", "GET / HTTP/1.1\r\nAccept: */*\r\n\r\nHost: example.com\r\n", ""},
+		{"not http", "SSH-2.0-OpenSSH_8.4\r\nHost: example.com\r\n\r\n", ""},
+		{"incomplete", "GET / HTTP/1.1\r\nHost: example.com\r\n", "example.com"},
+		{"http2 preface", "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n", ""},
+		{"empty", "", ""},
+	}
+	for _, tt := range tests {
+		if got := sniffHost(bufio.NewReaderSize(strings.NewReader(tt.req), sniffBufSize)); got != tt.want {
+			t.Errorf("%s: sniffHost = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSniff(t *testing.T) {
+	tests := []struct {
+		name string
+		send []byte
+		want string
+	}{
+		{"tls", clientHello(t, "example.com"), "example.com:443"},
+		{"http", []byte("GET / HTTP/1.1\r\nHost: example.org\r\n\r\n"), "example.org:443"},
+		{"ip host", []byte("GET / HTTP/1.1\r\nHost: 192.0.2.9\r\n\r\n"), "192.0.2.1:443"},
+		{"server first", nil, "192.0.2.1:443"},
+	}
+	for _, tt := range tests {
+		c, s := net.Pipe()
+		go func(b []byte) {
+			if b != nil {
+				c.Write(b)
+			}
+		}(tt.send)
+
+		addr, _ := NewAddr("tcp", "192.0.2.1:443")
+		start := time.Now()
+		conn, got := sniff(s, addr)
+		if got.String() != tt.want {
+			t.Errorf("%s: sniff = %s, want %s", tt.name, got, tt.want)
+		}
+		if tt.send == nil && time.Since(start) > 2*sniffTimeout {
+			t.Errorf("%s: sniff waited %s", tt.name, time.Since(start))
+		}
+
+		// The peeked bytes are replayed
+		c.Close()
+		b, _ := ioutil.ReadAll(conn)
+		if !bytes.Equal(b, tt.send) {
+			t.Errorf("%s: replayed %d bytes, want %d", tt.name, len(b), len(tt.send))
+		}
+	}
+}
@@ -1,14 +1,17 @@
 package main
 
 import (
+	"bufio"
+	"errors"
+	"fmt"
 	"io"
 	"net"
-	"net/url"
 	"strconv"
+	"sync"
+	"syscall"
 	"time"
 
 	log "github.com/sirupsen/logrus"
-	"golang.org/x/net/websocket"
 )
 
 const (
@@ -24,11 +27,34 @@ const (
 )
 
 const (
-	repSucceeded       = 0
-	repNotAllowed      = 2
-	repCmdNotSupported = 7
+	repSucceeded          = 0
+	repGeneralFailure     = 1
+	repNotAllowed         = 2
+	repNetworkUnreachable = 3
+	repHostUnreachable    = 4
+	repConnRefused        = 5
+	repTTLExpired         = 6
+	repCmdNotSupported    = 7
 )
 
+// relayTimeout is how long relays wait for either side to make progress.
+const relayTimeout = 30 * time.Second
+
+// zeroAddr is 0.0.0.0:0, for replies and requests without an address.
+var zeroAddr = &Addr{network: "tcp", addr: []byte{atypIPv4, 0, 0, 0, 0, 0, 0}}
+
+var (
+	errAddrType = errors.New("unsupported address type")
+	errDropped  = errors.New("dropped by rule")
+)
+
+// repError is a failure reply received from the remote.
+type repError byte
+
+func (e repError) Error() string {
+	return "remote replied " + strconv.Itoa(int(e))
+}
+
 type Addr struct {
 	net.Addr
 	network string
@@ -62,6 +88,8 @@ func ReadAddr(r io.Reader, network string) (addr *Addr, err error) {
 			return nil, e
 		}
 		n = 1 + net.IPv6len + 2
+	default:
+		return nil, errAddrType
 	}
 
 	a := make([]byte, n)
@@ -70,6 +98,32 @@ func ReadAddr(r io.Reader, network string) (addr *Addr, err error) {
 	return addr, nil
 }
 
+func NewAddr(network, hostport string) (*Addr, error) {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return nil, err
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+
+	var a []byte
+	ip := net.ParseIP(host)
+	if ip4 := ip.To4(); ip4 != nil {
+		a = append([]byte{atypIPv4}, ip4...)
+	} else if ip != nil {
+		a = append([]byte{atypIPv6}, ip...)
+	} else {
+		if len(host) > 255 {
+			return nil, errAddrType
+		}
+		a = append([]byte{atypDomainName, byte(len(host))}, host...)
+	}
+	a = append(a, byte(p>>8), byte(p))
+	return &Addr{network: network, addr: a}, nil
+}
+
 func (a *Addr) Network() string {
 	return a.network
 }
@@ -89,92 +143,279 @@ func (a *Addr) Host() string {
 	return host
 }
 
-func (a *Addr) String() string {
+func (a *Addr) Port() int {
 	buf := a.addr
-	port := strconv.Itoa((int(buf[len(buf)-2]) << 8) | int(buf[len(buf)-1]))
-	return net.JoinHostPort(a.Host(), port)
+	return (int(buf[len(buf)-2]) << 8) | int(buf[len(buf)-1])
 }
 
-type SocksSrv struct {
-	listener net.Listener
-	away     *Away
+func (a *Addr) String() string {
+	return net.JoinHostPort(a.Host(), strconv.Itoa(a.Port()))
+}
 
-	settings *Settings
-	remote   string
-	origin   string
-	security *Security
+type SocksSrv struct {
+	listeners []*listener
+	redir     net.Listener
+	tproxy    *tproxy
+	forwards  []*forward
+	reverses  []*reverse
+	dns       *dnsServer
+	tun       *tunStack
+	mux       *muxPool
+	pool      *wsPool
+	fake      *fakeIPs
+	acl       *acl
+	limits    *limiter
+	handshake time.Duration
+	away      *Away
+
+	settings  *Settings
+	transport transport
+	security  *Security
+	users     map[string]account
 
 	stop    chan struct{}
 	stopped chan struct{}
 }
 
 func NewSocksSrv(s *Settings, a *Away) (*SocksSrv, error) {
-	u, err := url.Parse(s.Remote)
+	conf, err := clientTLSConfig(s.RemoteCA, s.Pins, s.ClientCert, s.ClientKey)
 	if err != nil {
 		return nil, err
 	}
-	scheme := "ws"
-	if u.Scheme == "https" {
-		scheme = "wss"
-	}
-	remote := scheme + "://" + u.Host + "/_a"
-	origin := u.String()
-
-	security, err := NewSecurity(s.Passkey)
+	transport, err := newTransport(s, conf)
 	if err != nil {
 		return nil, err
 	}
 
-	l, err := net.Listen("tcp", ":"+s.Port)
+	// Client certificates alone secure tunnels without a passkey
+	var security *Security
+	if s.Passkey != "" || s.ClientCert == "" {
+		if security, err = NewSecurity(s.Passkey); err != nil {
+			return nil, err
+		}
+	} else if !overTLS(s.Remote) {
+		return nil, fmt.Errorf("Remote %s is not over TLS, tunnels need a passkey", s.Remote)
+	}
+
+	var users map[string]account
+	if s.Users != "" {
+		if users, err = LoadUsers(s.Users); err != nil {
+			return nil, err
+		}
+		log.Infof("Initilize [%d] users.", len(users))
+	}
+
+	var reverses []*reverse
+	for _, spec := range s.Reverses {
+		r, err := parseReverse(spec)
+		if err != nil {
+			return nil, err
+		}
+		reverses = append(reverses, r)
+	}
+
+	var fake *fakeIPs
+	if s.FakeIP != "" {
+		if fake, err = newFakeIPs(s.FakeIP); err != nil {
+			return nil, err
+		}
+	}
+
+	acl, err := newACL(s.Allow, s.Deny)
 	if err != nil {
 		return nil, err
 	}
 
+	handshake := s.HandshakeTimeout
+	if handshake <= 0 {
+		handshake = handshakeTimeout
+	}
+
 	srv := &SocksSrv{
-		listener: l,
-		away:     a,
-		settings: s,
-		remote:   remote,
-		origin:   origin,
-		security: security,
-		stop:     make(chan struct{}),
-		stopped:  make(chan struct{})}
+		reverses:  reverses,
+		acl:       acl,
+		limits:    newLimiter(s.MaxConns, s.MaxConnsPerIP),
+		handshake: handshake,
+		fake:      fake,
+		away:      a,
+		settings:  s,
+		transport: transport,
+		security:  security,
+		users:     users,
+		stop:      make(chan struct{}),
+		stopped:   make(chan struct{})}
+
+	if s.Pool > 0 {
+		srv.pool = newWSPool(s.Pool, srv.newConn, srv.stop)
+	}
+	if s.Mux > 0 {
+		srv.mux = newMuxPool(s.Mux, srv.dialConn)
+	}
 
+	if err := srv.listen(); err != nil {
+		srv.close()
+		return nil, err
+	}
 	return srv, nil
 }
 
+// listen opens every listening socket configured in settings.
+func (s *SocksSrv) listen() (err error) {
+	st := s.settings
+	host := ""
+	if len(st.Allow) == 0 { // only loopback clients are allowed anyway
+		host = "127.0.0.1"
+	}
+	if s.listeners, err = listenAll(st, host); err != nil {
+		return err
+	}
+	if st.RedirPort != "" {
+		if s.redir, err = net.Listen("tcp", ":"+st.RedirPort); err != nil {
+			return err
+		}
+	}
+	if st.TProxyPort != "" {
+		if s.tproxy, err = listenTProxy(":" + st.TProxyPort); err != nil {
+			return err
+		}
+	}
+	for _, spec := range st.Forwards {
+		f, err := listenForward(spec)
+		if err != nil {
+			return err
+		}
+		s.forwards = append(s.forwards, f)
+	}
+	if st.DNS != "" {
+		if s.dns, err = listenDNS(s, st.DNS, st.Resolver); err != nil {
+			return err
+		}
+	}
+	if st.Tun != "" {
+		if s.tun, err = listenTun(s, st.Tun); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// close closes every listening socket.
+func (s *SocksSrv) close() {
+	closeListeners(s.listeners)
+	if s.redir != nil {
+		s.redir.Close()
+	}
+	if s.tproxy != nil {
+		s.tproxy.Close()
+	}
+	for _, f := range s.forwards {
+		f.Close()
+	}
+	if s.dns != nil {
+		s.dns.Close()
+	}
+	if s.tun != nil {
+		s.tun.Close()
+	}
+	if s.mux != nil {
+		s.mux.Close()
+	}
+}
+
 func (s *SocksSrv) Stop() {
 	go func() {
 		close(s.stop)
-		s.listener.Close()
+		s.close()
 	}()
 	<-s.stopped
 }
 
 func (s *SocksSrv) Start() {
-	l := s.listener
+	var wg sync.WaitGroup
+	run := func(serve func()) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			serve()
+		}()
+	}
 
-	log.Infof("Away %s %c %s", l.Addr(), s.away.Mode(), s.remote)
+	if s.redir != nil {
+		run(s.serveRedir)
+	}
+	if s.tproxy != nil {
+		run(s.serveTProxy)
+	}
+	if s.dns != nil {
+		run(s.dns.serve)
+	}
+	if s.tun != nil {
+		run(s.serveTun)
+	}
+	if s.pool != nil {
+		run(s.pool.run)
+	}
+	for _, f := range s.forwards {
+		f := f
+		run(func() { s.serveForward(f) })
+	}
+	for _, r := range s.reverses {
+		r := r
+		run(func() { s.serveReverse(r) })
+	}
+	for _, l := range s.listeners {
+		l := l
+		run(func() { s.serve(l) })
+	}
+	wg.Wait()
+	close(s.stopped)
+}
+
+func (s *SocksSrv) serve(l *listener) {
+	mode := l.mode
+	if mode == 0 {
+		mode = s.away.Mode()
+	}
+	log.Infof("Away %s %c %s", l.Addr(), mode, s.transport)
 
 	for {
 		oc, err := l.Accept()
 		if err != nil {
 			select {
 			case <-s.stop:
-				close(s.stopped)
 				return
 			default:
 				log.Warn("Accepting connection failure: ", err)
 				continue
 			}
 		}
+		if !s.acl.allowed(oc.RemoteAddr()) {
+			oc.Close()
+			continue
+		}
+		ip := connIP(oc.RemoteAddr())
+		if err := s.limits.acquire(ip); err != nil {
+			s.reject(oc, err)
+			continue
+		}
 
 		go func(oc net.Conn) {
 			defer func() {
 				oc.Close()
+				s.limits.release(ip)
 			}()
 
 			keepAlive(oc)
+			oc.SetDeadline(time.Now().Add(s.handshake))
+
+			bc := newBufConn(oc)
+			oc = bc
+			if b, err := bc.r.Peek(1); err != nil {
+				return
+			} else if b[0] != 4 && b[0] != 5 {
+				s.serveHTTP(bc, l.mode)
+				return
+			}
 
 			buf := make([]byte, 300)
 
@@ -189,6 +430,10 @@ func (s *SocksSrv) Start() {
 				return
 			}
 			ver := buf[0]
+			if ver == 4 {
+				s.socks4(oc, buf[1], l.mode)
+				return
+			}
 			if ver != 5 {
 				return
 			}
@@ -204,9 +449,23 @@ func (s *SocksSrv) Start() {
 			// | 1  |   1    |
 			// +----+--------+
 
-			if _, err := oc.Write([]byte{5, 0}); err != nil {
+			mode := l.mode
+			method := selectMethod(buf[:nmethods], s.users != nil)
+			if _, err := oc.Write([]byte{5, method}); err != nil {
 				return
 			}
+			switch method {
+			case methodNoAcceptable:
+				return
+			case methodUserPass:
+				user, err := authenticate(oc, s.users)
+				if err != nil {
+					log.Warnf("Auth %s@%s failure: %s", user, oc.RemoteAddr().String(), err)
+					return
+				}
+				oc = &userConn{oc, user}
+				mode = userMode(s.users, user, mode)
+			}
 
 			// Requests
 			// +----+-----+-------+------+----------+----------+
@@ -225,93 +484,234 @@ func (s *SocksSrv) Start() {
 				log.Warn("Read addr failure: ", err)
 				return
 			}
+			addr = s.realAddr(addr)
 
-			// Replies
-			m := s.away.ResloveMode(addr)
+			m := s.away.ResloveModeWith(mode, addr)
 			switch cmd {
 			case cmdConnect:
-				var rep byte = repSucceeded
-				if m == ModeDrop {
-					rep = repNotAllowed
-				}
-				reply(oc, rep)
+			case cmdBind:
+				s.bind(oc, addr, m)
+				return
+			case cmdUdp:
+				addr.network = "udp"
+				s.associate(oc, addr, mode)
+				return
 			default:
-				reply(oc, repCmdNotSupported)
+				reply(oc, repCmdNotSupported, nil)
 				return
 			}
 
-			// Relay to remote
-			s.route(oc, addr, m)
+			// Relay to remote, replying once the dial is done
+			s.route(oc, addr, m, func(bnd *Addr, err error) error {
+				_, e := reply(oc, repCode(err), bnd)
+				return e
+			})
 		}(oc)
 	}
 }
 
-func reply(conn net.Conn, rep byte) (int, error) {
+func reply(conn net.Conn, rep byte, bnd *Addr) (int, error) {
 	// +----+-----+-------+------+----------+----------+
 	// |VER | REP |  RSV  | ATYP | BND.ADDR | BND.PORT |
 	// +----+-----+-------+------+----------+----------+
 	// | 1  |  1  | X'00' |  1   | Variable |    2     |
 	// +----+-----+-------+------+----------+----------+
-	return conn.Write([]byte{5, rep, 0, atypIPv4, 0, 0, 0, 0, 0, 0})
+	if bnd == nil {
+		bnd = zeroAddr
+	}
+	return conn.Write(append([]byte{5, rep, 0}, bnd.addr...))
+}
+
+// repCode maps a dial error to its reply code.
+func repCode(err error) byte {
+	if err == nil {
+		return repSucceeded
+	}
+	if e, ok := err.(repError); ok {
+		return byte(e)
+	}
+	if err == errDropped {
+		return repNotAllowed
+	}
+	if e, ok := err.(net.Error); ok && e.Timeout() {
+		return repTTLExpired
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return repHostUnreachable
+	}
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		switch errno {
+		case syscall.ECONNREFUSED:
+			return repConnRefused
+		case syscall.EHOSTUNREACH:
+			return repHostUnreachable
+		case syscall.ENETUNREACH:
+			return repNetworkUnreachable
+		case syscall.ETIMEDOUT:
+			return repTTLExpired
+		}
+	}
+	return repGeneralFailure
 }
 
-func (s *SocksSrv) route(conn net.Conn, addr *Addr, mode rune) {
-	log.Infof("%c %s->%s", mode, conn.RemoteAddr().String(), addr.String())
+// replyFunc reports the outcome of the dial, with the bound address on
+// success, before any data is relayed.
+type replyFunc func(bnd *Addr, err error) error
+
+func (s *SocksSrv) route(conn net.Conn, addr *Addr, mode rune, rf replyFunc) {
+	conn.SetDeadline(time.Time{}) // handshake done
+	log.Infof("%c %s->%s", mode, clientName(conn), addr.String())
 
 	if mode == ModeDrop {
+		if rf != nil {
+			rf(nil, errDropped)
+		}
 		conn.Close()
 		log.Infof("%c %s", mode, addr.String())
 		return
 	}
 
-	var ac net.Conn
-	var err error
+	// Clients only send their first bytes once told the dial is done, so
+	// sniffing replies before dialing.
+	rc := conn
+	early := false
+	if s.settings.Sniff && addr.addr[0] != atypDomainName {
+		if rf != nil {
+			if err := rf(nil, nil); err != nil {
+				return
+			}
+			rf, early = nil, true
+		}
+		var sa *Addr
+		if rc, sa = sniff(conn, addr); sa != addr {
+			if mode == ModeRule {
+				mode = s.away.ResloveModeWith(mode, sa)
+			}
+			log.Infof("%c %s->%s sniffed %s", mode, clientName(conn), addr.String(), sa.Host())
+			addr = sa
+			if mode == ModeDrop {
+				log.Infof("%c %s", mode, addr.String())
+				return
+			}
+		}
+	}
+
+	ac, mode, bnd, err := s.dial(addr, mode)
+	if rf != nil {
+		if e := rf(bnd, err); e != nil && err == nil {
+			ac.Close()
+			return
+		}
+	}
+	if err != nil {
+		if early {
+			// The client was told it succeeded, only closing tells otherwise
+			log.Warnf("Dial %c %s failure after replying success: %s", mode, addr.String(), err)
+		} else {
+			log.Warnf("Dial %c %s failure: %s", mode, addr.String(), err)
+		}
+		return
+	}
+	defer ac.Close()
+
+	nout, nin, err := relay(ac, rc)
+	if err != nil {
+		log.Warn("Relay remote failure: ", err)
+	}
+	log.Infof("%c %s->%s <%d %d>", mode, clientName(conn), addr.String(), nin, nout)
+}
+
+// dial connects to addr according to mode and returns the mode actually
+// used with the bound address.
+func (s *SocksSrv) dial(addr *Addr, mode rune) (ac net.Conn, m rune, bnd *Addr, err error) {
 	if mode == ModeRule {
 		timeout := 5 * time.Second
 		ac, err = net.DialTimeout(addr.Network(), addr.String(), timeout)
 		if e, ok := err.(net.Error); ok && e.Timeout() { // we choose to fall through to away mode
-			ac, err = s.dialRemote(addr)
-			mode = ModeAway
+			ac, bnd, err = s.dialRemote(addr)
+			return ac, ModeAway, bnd, err
 		}
 	} else if mode == ModeAway {
-		ac, err = s.dialRemote(addr)
+		ac, bnd, err = s.dialRemote(addr)
+		return ac, mode, bnd, err
 	} else if mode == ModePass {
 		ac, err = net.Dial(addr.Network(), addr.String())
 	}
-	if err != nil {
-		log.Warnf("Dial %c %s failure: %s", mode, addr.String(), err)
-		return
+	if err == nil {
+		bnd, _ = NewAddr(addr.Network(), ac.LocalAddr().String())
 	}
-	defer ac.Close()
+	return ac, mode, bnd, err
+}
 
-	nout, nin, err := relay(ac, conn)
+// dialRemote connects to addr through the remote.
+func (s *SocksSrv) dialRemote(addr *Addr) (net.Conn, *Addr, error) {
+	return s.dialTunnel(cmdConnect, addr)
+}
+
+// dialTunnel opens a tunnel for cmd and waits for the remote's reply.
+func (s *SocksSrv) dialTunnel(cmd byte, addr *Addr) (net.Conn, *Addr, error) {
+	ac, err := s.openTunnel(cmd, addr)
 	if err != nil {
-		log.Warn("Relay remote failure: ", err)
+		return nil, nil, err
+	}
+	bnd, err := readReply(ac, addr.Network())
+	if err != nil {
+		ac.Close()
+		return nil, nil, err
 	}
-	log.Infof("%c %s->%s <%d %d>", mode, conn.RemoteAddr().String(), addr.String(), nin, nout)
+	return ac, bnd, nil
 }
 
-func (s *SocksSrv) dialRemote(addr *Addr) (net.Conn, error) {
-	ws, err := websocket.Dial(s.remote, "", s.origin)
+// openTunnel opens a tunnel, on a mux session when enabled and not full,
+// and sends the request for cmd.
+func (s *SocksSrv) openTunnel(cmd byte, addr *Addr) (net.Conn, error) {
+	var ac net.Conn
+	err := errMuxUnsupported
+	if s.mux != nil {
+		ac, err = s.mux.open()
+	}
+	if err == errMuxUnsupported || err == errMuxFull {
+		ac, err = s.dialConn()
+	}
 	if err != nil {
 		return nil, err
 	}
-	ac := s.security.secure(ws)
 
-	if _, err := ac.Write(addr.addr); err != nil {
+	if err := writeRequest(ac, cmd, addr); err != nil {
 		ac.Close()
 		return nil, err
 	}
 	return ac, nil
 }
 
+// dialConn opens a secured connection to the remote, taken from the pool
+// when one is warm.
+func (s *SocksSrv) dialConn() (net.Conn, error) {
+	if s.pool != nil {
+		if conn := s.pool.get(); conn != nil {
+			return conn, nil
+		}
+	}
+	return s.newConn()
+}
+
+func (s *SocksSrv) newConn() (net.Conn, error) {
+	conn, err := s.transport.dial()
+	if err != nil {
+		return nil, err
+	}
+	return s.security.secure(conn), nil
+}
+
 type relayResult struct {
 	n int64
 	e error
 }
 
 func relay(wf, rf net.Conn) (nout, nin int64, err error) {
-	timeout := 30 * time.Second
+	timeout := relayTimeout
 	res := make(chan relayResult)
 	go func() {
 		nin, err = timeoutCopy(rf, wf, timeout)
@@ -362,6 +762,65 @@ func timeoutCopy(dst, src net.Conn, timeout time.Duration) (written int64, err e
 	return written, err
 }
 
+// idleConn pushes its deadline forward on each read and write, failing
+// only once idle for timeout.
+type idleConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *idleConn) Read(b []byte) (int, error) {
+	c.Conn.SetDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Read(b)
+}
+
+func (c *idleConn) Write(b []byte) (int, error) {
+	c.Conn.SetDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Write(b)
+}
+
+// bufConn reads through r so that peeked bytes are not lost.
+type bufConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func newBufConn(conn net.Conn) *bufConn {
+	return &bufConn{conn, bufio.NewReader(conn)}
+}
+
+func (c *bufConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// deadline wakes up the waiters of a condition once passed, for conns
+// blocking on a sync.Cond.
+type deadline struct {
+	t     time.Time
+	timer *time.Timer
+}
+
+// set moves the deadline to t, zero meaning none, with cond.L held.
+func (d *deadline) set(t time.Time, cond *sync.Cond) {
+	d.t = t
+	if d.timer != nil {
+		d.timer.Stop()
+		d.timer = nil
+	}
+	if !t.IsZero() {
+		d.timer = time.AfterFunc(time.Until(t), func() {
+			cond.L.Lock()
+			cond.Broadcast()
+			cond.L.Unlock()
+		})
+	}
+	cond.Broadcast()
+}
+
+func (d *deadline) exceeded() bool {
+	return !d.t.IsZero() && !time.Now().Before(d.t)
+}
+
 func keepAlive(conn net.Conn) {
 	if tcp, ok := conn.(*net.TCPConn); ok {
 		tcp.SetKeepAlive(true)
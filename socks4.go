@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	rep4Granted  = 90
+	rep4Rejected = 91
+)
+
+var errSocks4String = errors.New("socks4 string too long")
+
+// socks4 serves a SOCKS4 or SOCKS4a request whose VN and CD are already read.
+// http://ftp.icm.edu.pl/packages/socks/socks4/SOCKS4.protocol
+// https://www.openssh.com/txt/socks4a.protocol
+func (s *SocksSrv) socks4(oc net.Conn, cmd byte, mode rune) {
+	addr, err := readSocks4Addr(oc)
+	if err != nil {
+		return
+	}
+	addr = s.realAddr(addr)
+
+	if s.users != nil {
+		log.Warnf("Auth %s failure: socks4 cannot authenticate", oc.RemoteAddr().String())
+		reply4(oc, rep4Rejected)
+		return
+	}
+	if cmd != cmdConnect {
+		reply4(oc, rep4Rejected)
+		return
+	}
+
+	s.route(oc, addr, s.away.ResloveModeWith(mode, addr), func(_ *Addr, err error) error {
+		var rep byte = rep4Granted
+		if err != nil {
+			rep = rep4Rejected
+		}
+		_, e := reply4(oc, rep)
+		return e
+	})
+}
+
+// readSocks4Addr reads the rest of a SOCKS4 request, the destination of which
+// is a domain name for SOCKS4a.
+func readSocks4Addr(r io.Reader) (*Addr, error) {
+	// +----+----+---------+--------+--------+------+
+	// | VN | CD | DSTPORT | DSTIP  | USERID | NULL |
+	// +----+----+---------+--------+--------+------+
+	// | 1  | 1  |    2    |   4    |   -    |  1   |
+	// +----+----+---------+--------+--------+------+
+
+	buf := make([]byte, 6)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	port, ip := buf[0:2], buf[2:6]
+	if _, err := readCString(r); err != nil {
+		return nil, err
+	}
+
+	var a []byte
+	if ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0 { // SOCKS4a
+		host, err := readCString(r)
+		if err != nil {
+			return nil, err
+		}
+		if len(host) == 0 {
+			return nil, errAddrType
+		}
+		a = append([]byte{atypDomainName, byte(len(host))}, host...)
+	} else {
+		a = append([]byte{atypIPv4}, ip...)
+	}
+	return &Addr{network: "tcp", addr: append(a, port...)}, nil
+}
+
+func reply4(conn net.Conn, rep byte) (int, error) {
+	// +----+----+---------+-------+
+	// | VN | CD | DSTPORT | DSTIP |
+	// +----+----+---------+-------+
+	// | 1  | 1  |    2    |   4   |
+	// +----+----+---------+-------+
+	return conn.Write([]byte{0, rep, 0, 0, 0, 0, 0, 0})
+}
+
+func readCString(r io.Reader) ([]byte, error) {
+	s := make([]byte, 0, 32)
+	b := make([]byte, 1)
+	for {
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		if b[0] == 0 {
+			return s, nil
+		}
+		if len(s) == 255 {
+			return nil, errSocks4String
+		}
+		s = append(s, b[0])
+	}
+}
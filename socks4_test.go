@@ -0,0 +1,40 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestReadSocks4Addr(t *testing.T) {
+	long := strings.Repeat("a", 256)
+	tests := []struct {
+		name string
+		req  string
+		addr string
+		err  error
+	}{
+		{"socks4", "\x00\x50\xc0\x00\x02\x01\x00", "192.0.2.1:80", nil},
+		{"socks4 userid", "\x01\xbb\xc0\x00\x02\x01bob\x00", "192.0.2.1:443", nil},
+		{"socks4a", "\x00\x50\x00\x00\x00\x01\x00example.com\x00", "example.com:80", nil},
+		{"socks4a userid", "\x00\x50\x00\x00\x00\x07bob\x00example.com\x00", "example.com:80", nil},
+		{"unspecified ip", "\x00\x50\x00\x00\x00\x00\x00", "0.0.0.0:80", nil},
+		{"socks4a empty host", "\x00\x50\x00\x00\x00\x01\x00\x00", "", errAddrType},
+		{"socks4a long host", "\x00\x50\x00\x00\x00\x01\x00" + long + "\x00", "", errSocks4String},
+		{"long userid", "\x00\x50\xc0\x00\x02\x01" + long + "\x00", "", errSocks4String},
+		{"truncated", "\x00\x50\xc0", "", io.ErrUnexpectedEOF},
+		{"unterminated userid", "\x00\x50\xc0\x00\x02\x01bob", "", io.EOF},
+		{"unterminated host", "\x00\x50\x00\x00\x00\x01\x00example", "", io.EOF},
+	}
+	for _, tt := range tests {
+		addr, err := readSocks4Addr(bytes.NewReader([]byte(tt.req)))
+		if err != tt.err {
+			t.Errorf("%s: readSocks4Addr error %v, want %v", tt.name, err, tt.err)
+			continue
+		}
+		if err == nil && addr.String() != tt.addr {
+			t.Errorf("%s: readSocks4Addr = %s, want %s", tt.name, addr, tt.addr)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestRepCode(t *testing.T) {
+	opErr := func(errno syscall.Errno) error {
+		return &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", errno)}
+	}
+	tests := []struct {
+		err  error
+		want byte
+	}{
+		{nil, repSucceeded},
+		{repError(repHostUnreachable), repHostUnreachable},
+		{repError(repConnRefused), repConnRefused},
+		{errDropped, repNotAllowed},
+		{os.ErrDeadlineExceeded, repTTLExpired},
+		{&net.DNSError{Err: "no such host", Name: "example.invalid", IsNotFound: true}, repHostUnreachable},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{Err: "no such host"}}, repHostUnreachable},
+		{opErr(syscall.ECONNREFUSED), repConnRefused},
+		{opErr(syscall.EHOSTUNREACH), repHostUnreachable},
+		{opErr(syscall.ENETUNREACH), repNetworkUnreachable},
+		{opErr(syscall.ETIMEDOUT), repTTLExpired},
+		{fmt.Errorf("dial: %w", syscall.ECONNREFUSED), repConnRefused},
+		{opErr(syscall.EACCES), repGeneralFailure},
+		{errors.New("websocket: bad handshake"), repGeneralFailure},
+	}
+	for _, tt := range tests {
+		if got := repCode(tt.err); got != tt.want {
+			t.Errorf("repCode(%v) = %d, want %d", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestReply(t *testing.T) {
+	v4, _ := NewAddr("tcp", "192.0.2.1:1080")
+	v6, _ := NewAddr("tcp", "[2001:db8::1]:443")
+	name, _ := NewAddr("tcp", "example.com:80")
+	tests := []struct {
+		rep  byte
+		bnd  *Addr
+		want []byte
+	}{
+		{repSucceeded, nil, []byte{5, 0, 0, atypIPv4, 0, 0, 0, 0, 0, 0}},
+		{repConnRefused, nil, []byte{5, 5, 0, atypIPv4, 0, 0, 0, 0, 0, 0}},
+		{repSucceeded, v4, []byte{5, 0, 0, atypIPv4, 192, 0, 2, 1, 0x04, 0x38}},
+		{repSucceeded, v6, append(append([]byte{5, 0, 0, atypIPv6}, net.ParseIP("2001:db8::1")...), 0x01, 0xbb)},
+		{repSucceeded, name, append([]byte{5, 0, 0, atypDomainName, 11}, "example.com\x00\x50"...)},
+	}
+	for _, tt := range tests {
+		c, rc := net.Pipe()
+		go func(rep byte, bnd *Addr) {
+			reply(rc, rep, bnd)
+			rc.Close()
+		}(tt.rep, tt.bnd)
+		b := make([]byte, 64)
+		n, _ := c.Read(b)
+		c.Close()
+		if !bytes.Equal(b[:n], tt.want) {
+			t.Errorf("reply(%d, %v) = %v, want %v", tt.rep, tt.bnd, b[:n], tt.want)
+		}
+	}
+}
+
+// TestRouteReply checks the outcome of direct dials reaches the client,
+// with the address the connection is bound to.
+func TestRouteReply(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+
+	tests := []struct {
+		mode rune
+		addr string
+		rep  byte
+	}{
+		{ModePass, l.Addr().String(), repSucceeded},
+		{ModePass, closed.Addr().String(), repConnRefused},
+		{ModeDrop, l.Addr().String(), repNotAllowed},
+	}
+	s := &SocksSrv{settings: &Settings{}}
+	for _, tt := range tests {
+		addr, _ := NewAddr("tcp", tt.addr)
+		c, oc := net.Pipe()
+		var bnd *Addr
+		var rep byte
+		done := make(chan struct{})
+		go func() {
+			s.route(oc, addr, tt.mode, func(b *Addr, err error) error {
+				bnd, rep = b, repCode(err)
+				return nil
+			})
+			close(done)
+		}()
+
+		if tt.rep == repSucceeded {
+			ac, err := l.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+			c.Close()
+			ac.Close()
+			<-done
+			if bnd == nil || bnd.String() != ac.RemoteAddr().String() {
+				t.Errorf("%c %s: bound %v, want %s", tt.mode, tt.addr, bnd, ac.RemoteAddr())
+			}
+		} else {
+			<-done
+			c.Close()
+		}
+		if rep != tt.rep {
+			t.Errorf("%c %s: replied %d, want %d", tt.mode, tt.addr, rep, tt.rep)
+		}
+	}
+}
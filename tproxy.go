@@ -0,0 +1,257 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// tproxy holds the TCP and UDP sockets receiving traffic diverted by
+// iptables TPROXY. With IP_TRANSPARENT the local address of a TCP
+// connection is its original destination, while UDP destinations are
+// read from ancillary data.
+type tproxy struct {
+	tcp net.Listener
+	udp *net.UDPConn
+
+	mu    sync.Mutex
+	flows map[string]*tproxyFlow
+}
+
+func (tp *tproxy) Close() error {
+	tp.udp.Close()
+	return tp.tcp.Close()
+}
+
+func (s *SocksSrv) serveTProxy() {
+	tp := s.tproxy
+
+	log.Infof("TProxy %s %c", tp.tcp.Addr(), s.away.Mode())
+
+	go s.serveTProxyUDP()
+
+	for {
+		c, err := tp.tcp.Accept()
+		if err != nil {
+			select {
+			case <-s.stop:
+				return
+			default:
+				log.Warn("Accepting connection failure: ", err)
+				continue
+			}
+		}
+
+		if !s.acl.allowed(c.RemoteAddr()) {
+			c.Close()
+			continue
+		}
+		ip := connIP(c.RemoteAddr())
+		if err := s.limits.acquire(ip); err != nil {
+			s.limits.reject(c.RemoteAddr(), err)
+			c.Close()
+			continue
+		}
+
+		go func(c net.Conn) {
+			defer func() {
+				c.Close()
+				s.limits.release(ip)
+			}()
+
+			keepAlive(c)
+
+			la := c.LocalAddr().(*net.TCPAddr)
+			if isTProxySelf(la.IP, la.Port, tp.tcp.Addr()) {
+				log.Warnf("TProxy %s->%s is not diverted", c.RemoteAddr().String(), c.LocalAddr().String())
+				return
+			}
+			addr, err := NewAddr("tcp", c.LocalAddr().String())
+			if err != nil {
+				log.Warn("Original destination failure: ", err)
+				return
+			}
+			addr = s.realAddr(addr)
+			s.route(c, addr, s.away.ResloveMode(addr), nil)
+		}(c)
+	}
+}
+
+// isTProxySelf tells whether ip:port is the listener itself, which means
+// the traffic reached us without being diverted and would loop: the
+// listener port on its address, or on any local one when it listens on
+// all of them.
+func isTProxySelf(ip net.IP, port int, l net.Addr) bool {
+	h, p, _ := net.SplitHostPort(l.String())
+	if strconv.Itoa(port) != p {
+		return false
+	}
+	if lip := net.ParseIP(h); lip != nil && !lip.IsUnspecified() {
+		return lip.Equal(ip)
+	}
+	if ip.IsLoopback() {
+		return true
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return true
+	}
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && n.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// tproxyFlow relays datagrams of one (src, dst) tuple and spoofs the
+// replies from dst.
+type tproxyFlow struct {
+	key   string
+	src   *net.UDPAddr
+	dst   *Addr
+	mode  rune
+	up    net.Conn
+	spoof *net.UDPConn
+	idle  *time.Timer
+}
+
+func (s *SocksSrv) serveTProxyUDP() {
+	tp := s.tproxy
+	buf := make([]byte, udpBufSize)
+	for {
+		n, src, dst, err := readOrigDst(tp.udp, buf)
+		if err != nil {
+			select {
+			case <-s.stop:
+				return
+			default:
+				log.Warn("TProxy UDP read failure: ", err)
+				continue
+			}
+		}
+
+		if isTProxySelf(dst.IP, dst.Port, tp.udp.LocalAddr()) {
+			continue
+		}
+
+		key := src.String() + "|" + dst.String()
+		tp.mu.Lock()
+		f, ok := tp.flows[key]
+		tp.mu.Unlock()
+		if !ok {
+			if !s.acl.allowed(src) {
+				continue
+			}
+			ip := connIP(src)
+			if err := s.limits.acquire(ip); err != nil {
+				s.limits.reject(src, err)
+				continue
+			}
+			if f, err = s.newTProxyFlow(key, src, dst); err != nil || f == nil {
+				s.limits.release(ip)
+			}
+			if err != nil {
+				log.Warnf("TProxy UDP %s->%s failure: %s", src.String(), dst.String(), err)
+				continue
+			}
+			if f == nil {
+				continue
+			}
+		}
+
+		f.idle.Reset(udpTimeout)
+		if f.mode == ModeAway {
+			err = writeDatagram(f.up, f.dst, buf[:n])
+		} else {
+			_, err = f.up.Write(buf[:n])
+		}
+		if err != nil {
+			log.Warnf("TProxy UDP %s->%s failure: %s", src.String(), dst.String(), err)
+			s.closeTProxyFlow(f)
+		}
+	}
+}
+
+func (s *SocksSrv) newTProxyFlow(key string, src, dst *net.UDPAddr) (*tproxyFlow, error) {
+	addr, err := NewAddr("udp", dst.String())
+	if err != nil {
+		return nil, err
+	}
+	addr = s.realAddr(addr)
+	m := s.away.ResloveMode(addr)
+	log.Infof("%c UDP %s->%s", m, src.String(), addr.String())
+	if m == ModeDrop {
+		return nil, nil
+	}
+
+	var up net.Conn
+	if m == ModeAway {
+		up, _, err = s.dialTunnel(cmdUdp, addr)
+	} else {
+		up, err = net.Dial("udp", addr.String())
+	}
+	if err != nil {
+		return nil, err
+	}
+	spoof, err := listenSpoof(dst)
+	if err != nil {
+		up.Close()
+		return nil, err
+	}
+
+	f := &tproxyFlow{key: key, src: src, dst: addr, mode: m, up: up, spoof: spoof}
+	f.idle = time.AfterFunc(udpTimeout, func() { s.closeTProxyFlow(f) })
+
+	tp := s.tproxy
+	tp.mu.Lock()
+	tp.flows[key] = f
+	tp.mu.Unlock()
+
+	go s.replyTProxyFlow(f)
+	return f, nil
+}
+
+func (s *SocksSrv) replyTProxyFlow(f *tproxyFlow) {
+	defer s.closeTProxyFlow(f)
+
+	buf := make([]byte, udpBufSize)
+	for {
+		var n int
+		var err error
+		if f.mode == ModeAway {
+			_, n, err = readDatagram(f.up, buf)
+		} else {
+			n, err = f.up.Read(buf)
+		}
+		if err != nil {
+			return
+		}
+		f.idle.Reset(udpTimeout)
+		if _, err := f.spoof.WriteToUDP(buf[:n], f.src); err != nil {
+			log.Warn("TProxy UDP reply failure: ", err)
+			return
+		}
+	}
+}
+
+func (s *SocksSrv) closeTProxyFlow(f *tproxyFlow) {
+	tp := s.tproxy
+	tp.mu.Lock()
+	closed := tp.flows[f.key] == f
+	if closed {
+		delete(tp.flows, f.key)
+	}
+	tp.mu.Unlock()
+	if !closed {
+		return
+	}
+	s.limits.release(connIP(f.src))
+
+	f.idle.Stop()
+	f.up.Close()
+	f.spoof.Close()
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+var errNoOrigDst = errors.New("missing original destination")
+
+func listenTProxy(addr string) (*tproxy, error) {
+	ctx := context.Background()
+	lc := &net.ListenConfig{Control: transparent(false)}
+	l, err := lc.Listen(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	lc = &net.ListenConfig{Control: transparent(true)}
+	pc, err := lc.ListenPacket(ctx, "udp", addr)
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	return &tproxy{tcp: l, udp: pc.(*net.UDPConn), flows: make(map[string]*tproxyFlow)}, nil
+}
+
+// transparent sets IP_TRANSPARENT and, when origdst, asks for the original
+// destination of each datagram.
+func transparent(origdst bool) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		ipv6 := network[len(network)-1] == '6'
+		var serr error
+		err := c.Control(func(fd uintptr) {
+			opts := [][2]int{{unix.SOL_IP, unix.IP_TRANSPARENT}}
+			if origdst {
+				opts = append(opts, [2]int{unix.SOL_IP, unix.IP_RECVORIGDSTADDR})
+			}
+			if ipv6 {
+				opts = append(opts, [2]int{unix.SOL_IPV6, unix.IPV6_TRANSPARENT})
+				if origdst {
+					opts = append(opts, [2]int{unix.SOL_IPV6, unix.IPV6_RECVORIGDSTADDR})
+				}
+			}
+			for _, o := range opts {
+				if serr = unix.SetsockoptInt(int(fd), o[0], o[1], 1); serr != nil {
+					return
+				}
+			}
+		})
+		if err != nil {
+			return err
+		}
+		return serr
+	}
+}
+
+// readOrigDst reads a datagram diverted by TPROXY with its source and
+// original destination.
+func readOrigDst(c *net.UDPConn, b []byte) (n int, src, dst *net.UDPAddr, err error) {
+	oob := make([]byte, 128)
+	n, oobn, _, src, err := c.ReadMsgUDP(b, oob)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	msgs, err := unix.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	for _, m := range msgs {
+		switch {
+		case m.Header.Level == unix.SOL_IP && m.Header.Type == unix.IP_ORIGDSTADDR && len(m.Data) >= 8:
+			// struct sockaddr_in
+			ip := net.IPv4(m.Data[4], m.Data[5], m.Data[6], m.Data[7])
+			dst = &net.UDPAddr{IP: ip, Port: int(m.Data[2])<<8 | int(m.Data[3])}
+		case m.Header.Level == unix.SOL_IPV6 && m.Header.Type == unix.IPV6_ORIGDSTADDR && len(m.Data) >= 24:
+			// struct sockaddr_in6
+			ip := make(net.IP, net.IPv6len)
+			copy(ip, m.Data[8:24])
+			dst = &net.UDPAddr{IP: ip, Port: int(m.Data[2])<<8 | int(m.Data[3])}
+		}
+	}
+	if dst == nil {
+		return 0, nil, nil, errNoOrigDst
+	}
+	return n, src, dst, nil
+}
+
+// listenSpoof opens a socket bound to the foreign address dst so replies
+// appear to come from the original destination.
+func listenSpoof(dst *net.UDPAddr) (*net.UDPConn, error) {
+	network := "udp6"
+	if dst.IP.To4() != nil {
+		network = "udp4"
+	}
+	lc := &net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+		var serr error
+		err := c.Control(func(fd uintptr) {
+			if serr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1); serr != nil {
+				return
+			}
+			if network == "udp6" {
+				serr = unix.SetsockoptInt(int(fd), unix.SOL_IPV6, unix.IPV6_TRANSPARENT, 1)
+			} else {
+				serr = unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_TRANSPARENT, 1)
+			}
+		})
+		if err != nil {
+			return err
+		}
+		return serr
+	}}
+	pc, err := lc.ListenPacket(context.Background(), network, dst.String())
+	if err != nil {
+		return nil, err
+	}
+	return pc.(*net.UDPConn), nil
+}
@@ -0,0 +1,22 @@
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+var errTProxy = errors.New("tproxy is only supported on linux")
+
+func listenTProxy(addr string) (*tproxy, error) {
+	return nil, errTProxy
+}
+
+func readOrigDst(c *net.UDPConn, b []byte) (n int, src, dst *net.UDPAddr, err error) {
+	return 0, nil, nil, errTProxy
+}
+
+func listenSpoof(dst *net.UDPAddr) (*net.UDPConn, error) {
+	return nil, errTProxy
+}
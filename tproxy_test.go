@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestIsTProxySelf(t *testing.T) {
+	var local net.IP
+	addrs, _ := net.InterfaceAddrs()
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && !n.IP.IsLoopback() {
+			local = n.IP
+			break
+		}
+	}
+
+	wildcard := &net.TCPAddr{IP: net.IPv4zero, Port: 1082}
+	bound := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1082}
+	tests := []struct {
+		ip   net.IP
+		port int
+		l    net.Addr
+		want bool
+	}{
+		{net.IPv4(127, 0, 0, 1), 1082, wildcard, true},
+		{net.IPv6loopback, 1082, wildcard, true},
+		{net.IPv4(127, 0, 0, 1), 80, wildcard, false},
+		{net.IPv4(198, 51, 100, 7), 1082, wildcard, false},
+		{net.IPv4(192, 0, 2, 1), 1082, bound, true},
+		{net.IPv4(192, 0, 2, 2), 1082, bound, false},
+		{net.IPv4(127, 0, 0, 1), 1082, bound, false},
+		{net.IPv4(192, 0, 2, 1), 1083, bound, false},
+	}
+	if local != nil {
+		tests = append(tests, struct {
+			ip   net.IP
+			port int
+			l    net.Addr
+			want bool
+		}{local, 1082, wildcard, true})
+	}
+	for _, tt := range tests {
+		if got := isTProxySelf(tt.ip, tt.port, tt.l); got != tt.want {
+			t.Errorf("isTProxySelf(%s, %d, %s) = %v, want %v", tt.ip, tt.port, tt.l, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// transport opens the connections to the remote that tunnels are secured
+// on. Each write on them must reach the remote as one message, as SecConn
+// compresses and encrypts every write on its own.
+type transport interface {
+	dial() (net.Conn, error)
+	String() string
+}
+
+// wsPath is where the remote serves websockets by default.
+const wsPath = "/_a"
+
+// newTransport picks the transport of the remote URL of s: raw TCP for
+// tcp://, TLS for tls://, HTTP/2 for h2:// and h2c://, and websocket
+// otherwise. Those over TLS verify the remote with conf, and those over
+// HTTP send the Host, User-Agent and headers of s.
+func newTransport(s *Settings, conf *tls.Config) (transport, error) {
+	u, err := url.Parse(s.Remote)
+	if err != nil {
+		return nil, err
+	}
+	header, err := parseHeaders(s.Headers)
+	if err != nil {
+		return nil, err
+	}
+	if s.UserAgent != "" {
+		header.Set("User-Agent", s.UserAgent)
+	}
+	if s.SNI != "" {
+		conf = conf.Clone()
+		conf.ServerName = s.SNI
+	}
+	host := u.Host
+	if s.HostHeader != "" {
+		host = s.HostHeader
+	}
+
+	switch u.Scheme {
+	case "tcp":
+		return &streamTransport{addr: u.Host}, nil
+	case "tls":
+		addr := u.Host
+		if u.Port() == "" {
+			addr = net.JoinHostPort(u.Hostname(), "443")
+		}
+		conf = conf.Clone()
+		if s.SNI == "" {
+			conf.ServerName = u.Hostname()
+		}
+		conf.NextProtos = []string{streamALPN}
+		return &streamTransport{addr: addr, tls: conf}, nil
+	case "h2", "h2c":
+		return newH2Transport(u.Host, host, header, u.Scheme == "h2c", conf), nil
+	}
+
+	scheme, port := "ws", "80"
+	if u.Scheme == "https" || u.Scheme == "wss" {
+		scheme, port = "wss", "443"
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), port)
+	}
+	wc, err := websocket.NewConfig(scheme+"://"+host+wsPathOf(s), u.Scheme+"://"+host)
+	if err != nil {
+		return nil, err
+	}
+	wc.Header = header
+	if scheme == "wss" {
+		conf = conf.Clone()
+		if conf.ServerName == "" {
+			conf.ServerName = u.Hostname()
+		}
+		wc.TlsConfig = conf
+	}
+	return &wsTransport{config: wc, addr: addr}, nil
+}
+
+// overTLS tells whether the remote URL is reached over TLS.
+func overTLS(remote string) bool {
+	u, err := url.Parse(remote)
+	if err != nil {
+		return false
+	}
+	switch u.Scheme {
+	case "https", "wss", "tls", "h2":
+		return true
+	}
+	return false
+}
+
+// wsPathOf is the websocket path of s, wsPath by default.
+func wsPathOf(s *Settings) string {
+	if s.WSPath == "" {
+		return wsPath
+	}
+	return "/" + strings.TrimPrefix(s.WSPath, "/")
+}
+
+// parseHeaders parses the "Name: value" headers of list.
+func parseHeaders(list []string) (http.Header, error) {
+	header := make(http.Header)
+	for _, h := range list {
+		name, value, err := parseHeader(h)
+		if err != nil {
+			return nil, err
+		}
+		header.Add(name, value)
+	}
+	return header, nil
+}
+
+func parseHeader(h string) (string, string, error) {
+	i := strings.IndexByte(h, ':')
+	if i <= 0 {
+		return "", "", fmt.Errorf("Invalid header %s, want Name: value", h)
+	}
+	return strings.TrimSpace(h[:i]), strings.TrimSpace(h[i+1:]), nil
+}
+
+// wsTransport dials addr itself for the websocket to name another host in
+// its handshake, as for domain fronting.
+type wsTransport struct {
+	config *websocket.Config
+	addr   string
+}
+
+func (t *wsTransport) dial() (net.Conn, error) {
+	d := &net.Dialer{Timeout: dialTimeout}
+	var conn net.Conn
+	var err error
+	if t.config.TlsConfig != nil {
+		conn, err = tls.DialWithDialer(d, "tcp", t.addr, t.config.TlsConfig)
+	} else {
+		conn, err = d.Dial("tcp", t.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Now().Add(dialTimeout))
+	ws, err := websocket.NewClient(t.config, conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return ws, nil
+}
+
+func (t *wsTransport) String() string {
+	return t.config.Location.String()
+}
+
+// streamTransport carries the messages on a TCP or TLS connection, framed
+// by frameConn after streamPreface.
+type streamTransport struct {
+	addr string
+	tls  *tls.Config
+}
+
+// streamPreface starts stream transport connections, and can't start an
+// HTTP request so that the remote serves both on one port. Over TLS, they
+// are told apart by streamALPN instead.
+var streamPreface = []byte("\x00away1")
+
+const streamALPN = "away"
+
+func (t *streamTransport) dial() (net.Conn, error) {
+	d := &net.Dialer{Timeout: dialTimeout}
+	var conn net.Conn
+	var err error
+	if t.tls != nil {
+		conn, err = tls.DialWithDialer(d, "tcp", t.addr, t.tls)
+	} else {
+		conn, err = d.Dial("tcp", t.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(streamPreface); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return newFrameConn(conn, bufio.NewReader(conn)), nil
+}
+
+func (t *streamTransport) String() string {
+	if t.tls != nil {
+		return "tls://" + t.addr
+	}
+	return "tcp://" + t.addr
+}
+
+const maxFrame = 1 << 24
+
+var errFrameTooLarge = errors.New("frame too large")
+
+// frameConn preserves the boundaries of writes on a stream, each being
+// sent as
+// +-----+----------+
+// | LEN |   DATA   |
+// +-----+----------+
+// |  4  | Variable |
+// +-----+----------+
+// and a read never returning data of two frames, like a websocket.
+type frameConn struct {
+	net.Conn
+	r    *bufio.Reader
+	left int // unread bytes of the current frame
+
+	wmu sync.Mutex
+}
+
+func newFrameConn(conn net.Conn, r *bufio.Reader) *frameConn {
+	return &frameConn{Conn: conn, r: r}
+}
+
+func (c *frameConn) Read(b []byte) (int, error) {
+	for c.left == 0 {
+		var hdr [4]byte
+		if _, err := io.ReadFull(c.r, hdr[:]); err != nil {
+			return 0, err
+		}
+		l := binary.BigEndian.Uint32(hdr[:])
+		if l > maxFrame {
+			return 0, errFrameTooLarge
+		}
+		c.left = int(l)
+	}
+	if len(b) > c.left {
+		b = b[:c.left]
+	}
+	n, err := c.r.Read(b)
+	c.left -= n
+	return n, err
+}
+
+func (c *frameConn) Write(b []byte) (int, error) {
+	if len(b) > maxFrame {
+		return 0, errFrameTooLarge
+	}
+	frame := make([]byte, 4, 4+len(b))
+	binary.BigEndian.PutUint32(frame, uint32(len(b)))
+	frame = append(frame, b...)
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if _, err := c.Conn.Write(frame); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// splitListener passes the HTTP connections of a listener on, and serves
+// those of the stream transport itself.
+type splitListener struct {
+	net.Listener
+	serve func(net.Conn)
+
+	conns chan net.Conn
+	done  chan struct{}
+	err   error
+}
+
+func newSplitListener(l net.Listener, serve func(net.Conn)) *splitListener {
+	sl := &splitListener{
+		Listener: l,
+		serve:    serve,
+		conns:    make(chan net.Conn),
+		done:     make(chan struct{}),
+	}
+	go sl.run()
+	return sl
+}
+
+func (l *splitListener) run() {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(5 * time.Millisecond)
+				continue
+			}
+			l.err = err
+			close(l.done)
+			return
+		}
+		go l.split(c)
+	}
+}
+
+// split tells the transport of c from its first bytes, or its protocol
+// when over TLS, within the handshake timeout.
+func (l *splitListener) split(c net.Conn) {
+	c.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	tc, ok := c.(*tls.Conn)
+	if ok {
+		if err := tc.Handshake(); err != nil {
+			c.Close()
+			return
+		}
+		if tc.ConnectionState().NegotiatedProtocol != streamALPN {
+			// Passed on as is for the server to see TLS
+			l.pass(c)
+			return
+		}
+	}
+
+	bc := newBufConn(c)
+	b, err := bc.r.Peek(1)
+	if err != nil {
+		c.Close()
+		return
+	}
+	if b[0] != streamPreface[0] && !ok {
+		l.pass(bc)
+		return
+	}
+
+	p := make([]byte, len(streamPreface))
+	if _, err := io.ReadFull(bc.r, p); err != nil || !bytes.Equal(p, streamPreface) {
+		c.Close()
+		return
+	}
+	c.SetReadDeadline(time.Time{})
+	l.serve(newFrameConn(c, bc.r))
+}
+
+func (l *splitListener) pass(c net.Conn) {
+	c.SetReadDeadline(time.Time{})
+	select {
+	case l.conns <- c:
+	case <-l.done:
+		c.Close()
+	}
+}
+
+func (l *splitListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, l.err
+	}
+}
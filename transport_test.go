@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// recordConn records what is written to it.
+type recordConn struct {
+	net.Conn
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (c *recordConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.buf.Write(b)
+}
+
+func TestFrameConn(t *testing.T) {
+	tests := []struct {
+		name   string
+		writes []string
+		bufLen int
+		reads  []string
+	}{
+		{"one per read", []string{"hello", "away"}, 16, []string{"hello", "away"}},
+		{"split", []string{"hello", "away"}, 3, []string{"hel", "lo", "awa", "y"}},
+		{"exact", []string{"abc", "def"}, 3, []string{"abc", "def"}},
+		{"empty skipped", []string{"a", "", "b"}, 16, []string{"a", "b"}},
+		{"large", []string{strings.Repeat("x", 100000), "y"}, 1 << 20, nil},
+	}
+	for _, tt := range tests {
+		rc := &recordConn{}
+		w := newFrameConn(rc, nil)
+		for _, s := range tt.writes {
+			if n, err := w.Write([]byte(s)); n != len(s) || err != nil {
+				t.Fatalf("%s: Write = %d, %v", tt.name, n, err)
+			}
+		}
+
+		r := newFrameConn(nil, bufio.NewReader(&rc.buf))
+		b := make([]byte, tt.bufLen)
+		var reads []string
+		for {
+			n, err := r.Read(b)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("%s: Read: %v", tt.name, err)
+			}
+			reads = append(reads, string(b[:n]))
+		}
+		if tt.reads == nil { // frames larger than the buffer of bufio come in pieces
+			for _, r := range reads {
+				if strings.Count(r, r[:1]) != len(r) {
+					t.Errorf("%s: a read crossed frames", tt.name)
+				}
+			}
+			if strings.Join(reads, "") != strings.Join(tt.writes, "") {
+				t.Errorf("%s: read %d bytes, want %d", tt.name, len(strings.Join(reads, "")), len(strings.Join(tt.writes, "")))
+			}
+			continue
+		}
+		if strings.Join(reads, "|") != strings.Join(tt.reads, "|") {
+			t.Errorf("%s: reads %q, want %q", tt.name, reads, tt.reads)
+		}
+	}
+}
+
+func TestFrameConnErrors(t *testing.T) {
+	frame := func(l uint32, data string) []byte {
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, l)
+		return append(b, data...)
+	}
+	tests := []struct {
+		name string
+		in   []byte
+		want error
+	}{
+		{"too large", frame(maxFrame+1, ""), errFrameTooLarge},
+		{"short header", []byte{0, 0}, io.ErrUnexpectedEOF},
+		{"truncated data", frame(10, ""), io.EOF},
+		{"eof", nil, io.EOF},
+	}
+	for _, tt := range tests {
+		r := newFrameConn(nil, bufio.NewReader(bytes.NewReader(tt.in)))
+		if _, err := r.Read(make([]byte, 16)); err != tt.want {
+			t.Errorf("%s: Read error %v, want %v", tt.name, err, tt.want)
+		}
+	}
+
+	w := newFrameConn(&recordConn{}, nil)
+	if _, err := w.Write(make([]byte, maxFrame+1)); err != errFrameTooLarge {
+		t.Errorf("Write of a too large frame: %v, want %v", err, errFrameTooLarge)
+	}
+}
+
+func TestFrameConnConcurrentWrites(t *testing.T) {
+	rc := &recordConn{}
+	w := newFrameConn(rc, nil)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(c byte) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				w.Write(bytes.Repeat([]byte{c}, 1000+j))
+			}
+		}(byte('a' + i))
+	}
+	wg.Wait()
+
+	// Frames may come in pieces, but never mixed with others
+	r := newFrameConn(nil, bufio.NewReader(&rc.buf))
+	b := make([]byte, 4096)
+	total := 0
+	for {
+		n, err := r.Read(b)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Count(b[:n], b[:1]) != n {
+			t.Fatalf("a read mixes writes: %q", b[:n])
+		}
+		total += n
+	}
+	if want := 8 * (100*1000 + 99*100/2); total != want {
+		t.Errorf("read %d bytes, want %d", total, want)
+	}
+}
+
+func TestOverTLS(t *testing.T) {
+	tests := []struct {
+		remote string
+		want   bool
+	}{
+		{"https://away.remote", true},
+		{"wss://away.remote/_a", true},
+		{"tls://away.remote:8443", true},
+		{"h2://away.remote", true},
+		{"http://away.remote", false},
+		{"ws://away.remote", false},
+		{"tcp://away.remote:8080", false},
+		{"h2c://away.remote", false},
+		{"away.remote:443", false},
+		{"://", false},
+	}
+	for _, tt := range tests {
+		if got := overTLS(tt.remote); got != tt.want {
+			t.Errorf("overTLS(%q) = %v, want %v", tt.remote, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	tunMTU = 1500
+
+	protoTCP = 6
+	protoUDP = 17
+)
+
+// tunStack terminates the TCP and UDP flows of a TUN device, so that each
+// of them is routed like a SOCKS request. Only unfragmented IPv4 and IPv6
+// without extension headers are handled, anything else is dropped.
+type tunStack struct {
+	dev *os.File
+	srv *SocksSrv
+
+	wmu sync.Mutex // serializes packet writes
+
+	mu  sync.Mutex
+	tcp map[string]*tcpFlow
+	udp map[string]*tunUDPFlow
+}
+
+func listenTun(srv *SocksSrv, name string) (*tunStack, error) {
+	dev, err := openTun(name)
+	if err != nil {
+		return nil, err
+	}
+	return &tunStack{
+		dev: dev,
+		srv: srv,
+		tcp: make(map[string]*tcpFlow),
+		udp: make(map[string]*tunUDPFlow),
+	}, nil
+}
+
+func (t *tunStack) Close() error {
+	return t.dev.Close()
+}
+
+func (s *SocksSrv) serveTun() {
+	t := s.tun
+	log.Infof("Tun %s %c", s.settings.Tun, s.away.Mode())
+
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := t.dev.Read(buf)
+		if err != nil {
+			select {
+			case <-s.stop:
+			default:
+				log.Warn("Tun read failure: ", err)
+			}
+			return
+		}
+		src, dst, proto, payload, ok := parseIP(buf[:n])
+		if !ok {
+			continue
+		}
+		switch proto {
+		case protoTCP:
+			t.inputTCP(src, dst, payload)
+		case protoUDP:
+			t.inputUDP(src, dst, payload)
+		}
+	}
+}
+
+// parseIP returns the addresses, protocol and payload of packet b.
+func parseIP(b []byte) (src, dst net.IP, proto byte, payload []byte, ok bool) {
+	if len(b) < 1 {
+		return
+	}
+	switch b[0] >> 4 {
+	case 4:
+		// +-------+-----+-----+-----------+-------------+-----+-------+-----+-----+
+		// |VER/IHL| TOS | LEN | ID        | FLAGS/FRAG  | TTL | PROTO | SUM | ... |
+		// +-------+-----+-----+-----------+-------------+-----+-------+-----+-----+
+		if len(b) < 20 {
+			return
+		}
+		ihl := int(b[0]&0x0f) * 4
+		l := int(binary.BigEndian.Uint16(b[2:4]))
+		if ihl < 20 || l < ihl || l > len(b) {
+			return
+		}
+		if binary.BigEndian.Uint16(b[6:8])&0x3fff != 0 { // MF or offset
+			return
+		}
+		return net.IP(b[12:16]), net.IP(b[16:20]), b[9], b[ihl:l], true
+	case 6:
+		if len(b) < 40 {
+			return
+		}
+		l := 40 + int(binary.BigEndian.Uint16(b[4:6]))
+		if l > len(b) {
+			return
+		}
+		return net.IP(b[8:24]), net.IP(b[24:40]), b[6], b[40:l], true
+	}
+	return
+}
+
+// write sends transport, whose checksum is at offset sum, from src to dst.
+func (t *tunStack) write(src, dst net.IP, proto byte, transport []byte, sum int) error {
+	var pkt []byte
+	if len(src) == net.IPv4len {
+		pkt = make([]byte, 20, 20+len(transport))
+		pkt[0] = 0x45
+		binary.BigEndian.PutUint16(pkt[2:4], uint16(20+len(transport)))
+		pkt[6] = 0x40 // don't fragment
+		pkt[8] = 64
+		pkt[9] = proto
+		copy(pkt[12:16], src)
+		copy(pkt[16:20], dst)
+		binary.BigEndian.PutUint16(pkt[10:12], ^fold(checksum(0, pkt)))
+	} else {
+		pkt = make([]byte, 40, 40+len(transport))
+		pkt[0] = 0x60
+		binary.BigEndian.PutUint16(pkt[4:6], uint16(len(transport)))
+		pkt[6] = proto
+		pkt[7] = 64
+		copy(pkt[8:24], src)
+		copy(pkt[24:40], dst)
+	}
+
+	// Pseudo header
+	c := checksum(0, src)
+	c = checksum(c, dst)
+	c += uint32(proto) + uint32(len(transport))
+	binary.BigEndian.PutUint16(transport[sum:], 0)
+	s := ^fold(checksum(c, transport))
+	if s == 0 && proto == protoUDP {
+		s = 0xffff
+	}
+	binary.BigEndian.PutUint16(transport[sum:], s)
+
+	t.wmu.Lock()
+	defer t.wmu.Unlock()
+	_, err := t.dev.Write(append(pkt, transport...))
+	return err
+}
+
+func checksum(sum uint32, b []byte) uint32 {
+	for ; len(b) >= 2; b = b[2:] {
+		sum += uint32(b[0])<<8 | uint32(b[1])
+	}
+	if len(b) == 1 {
+		sum += uint32(b[0]) << 8
+	}
+	return sum
+}
+
+func fold(sum uint32) uint16 {
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return uint16(sum)
+}
+
+func flowKey(src net.IP, sport uint16, dst net.IP, dport uint16) string {
+	return net.JoinHostPort(src.String(), strconv.Itoa(int(sport))) + "|" +
+		net.JoinHostPort(dst.String(), strconv.Itoa(int(dport)))
+}
+
+// tunUDPFlow relays datagrams of one (src, dst) tuple and writes the
+// replies back as coming from dst.
+type tunUDPFlow struct {
+	key  string
+	src  *net.UDPAddr
+	dst  *net.UDPAddr
+	addr *Addr
+	mode rune
+	up   net.Conn
+	idle *time.Timer
+}
+
+func (t *tunStack) inputUDP(src, dst net.IP, b []byte) {
+	// +------+------+-----+-----+
+	// | SRC  | DST  | LEN | SUM |
+	// +------+------+-----+-----+
+	// |  2   |  2   |  2  |  2  |
+	// +------+------+-----+-----+
+	if len(b) < 8 {
+		return
+	}
+	sport, dport := binary.BigEndian.Uint16(b[0:2]), binary.BigEndian.Uint16(b[2:4])
+	l := int(binary.BigEndian.Uint16(b[4:6]))
+	if l < 8 || l > len(b) {
+		return
+	}
+	data := b[8:l]
+
+	key := flowKey(src, sport, dst, dport)
+	t.mu.Lock()
+	f, ok := t.udp[key]
+	t.mu.Unlock()
+	if !ok {
+		var err error
+		s := &net.UDPAddr{IP: append(net.IP(nil), src...), Port: int(sport)}
+		d := &net.UDPAddr{IP: append(net.IP(nil), dst...), Port: int(dport)}
+		if f, err = t.newUDPFlow(key, s, d); err != nil {
+			log.Warnf("Tun UDP %s->%s failure: %s", s.String(), d.String(), err)
+			return
+		}
+		if f == nil {
+			return
+		}
+	}
+
+	f.idle.Reset(udpTimeout)
+	var err error
+	if f.mode == ModeAway {
+		err = writeDatagram(f.up, f.addr, data)
+	} else {
+		_, err = f.up.Write(data)
+	}
+	if err != nil {
+		log.Warnf("Tun UDP %s->%s failure: %s", f.src.String(), f.addr.String(), err)
+		t.closeUDPFlow(f)
+	}
+}
+
+func (t *tunStack) newUDPFlow(key string, src, dst *net.UDPAddr) (*tunUDPFlow, error) {
+	s := t.srv
+	addr, err := NewAddr("udp", dst.String())
+	if err != nil {
+		return nil, err
+	}
+	addr = s.realAddr(addr)
+	m := s.away.ResloveMode(addr)
+	log.Infof("%c UDP %s->%s", m, src.String(), addr.String())
+	if m == ModeDrop {
+		return nil, nil
+	}
+
+	var up net.Conn
+	if m == ModeAway {
+		up, _, err = s.dialTunnel(cmdUdp, addr)
+	} else {
+		up, err = net.Dial("udp", addr.String())
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	f := &tunUDPFlow{key: key, src: src, dst: dst, addr: addr, mode: m, up: up}
+	f.idle = time.AfterFunc(udpTimeout, func() { t.closeUDPFlow(f) })
+
+	t.mu.Lock()
+	t.udp[key] = f
+	t.mu.Unlock()
+
+	go t.replyUDPFlow(f)
+	return f, nil
+}
+
+func (t *tunStack) replyUDPFlow(f *tunUDPFlow) {
+	defer t.closeUDPFlow(f)
+
+	buf := make([]byte, udpBufSize)
+	for {
+		var n int
+		var err error
+		if f.mode == ModeAway {
+			_, n, err = readDatagram(f.up, buf[8:])
+		} else {
+			n, err = f.up.Read(buf[8:])
+		}
+		if err != nil {
+			return
+		}
+		f.idle.Reset(udpTimeout)
+
+		udp := make([]byte, 8+n)
+		binary.BigEndian.PutUint16(udp[0:2], uint16(f.dst.Port))
+		binary.BigEndian.PutUint16(udp[2:4], uint16(f.src.Port))
+		binary.BigEndian.PutUint16(udp[4:6], uint16(8+n))
+		copy(udp[8:], buf[8:8+n])
+		if err := t.write(f.dst.IP, f.src.IP, protoUDP, udp, 6); err != nil {
+			log.Warn("Tun UDP reply failure: ", err)
+			return
+		}
+	}
+}
+
+func (t *tunStack) closeUDPFlow(f *tunUDPFlow) {
+	t.mu.Lock()
+	if t.udp[f.key] == f {
+		delete(t.udp, f.key)
+	}
+	t.mu.Unlock()
+
+	f.idle.Stop()
+	f.up.Close()
+}
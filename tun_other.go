@@ -0,0 +1,12 @@
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+func openTun(name string) (*os.File, error) {
+	return nil, errors.New("tun is only supported on linux")
+}
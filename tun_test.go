@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"testing"
+)
+
+func TestParseIP(t *testing.T) {
+	v4 := func(ihl byte, total, frag uint16, n int) []byte {
+		b := make([]byte, n)
+		b[0] = 0x40 | ihl
+		binary.BigEndian.PutUint16(b[2:4], total)
+		binary.BigEndian.PutUint16(b[6:8], frag)
+		b[9] = protoTCP
+		copy(b[12:16], []byte{10, 0, 0, 1})
+		copy(b[16:20], []byte{10, 0, 0, 2})
+		return b
+	}
+	v6 := func(plen uint16, n int) []byte {
+		b := make([]byte, n)
+		b[0] = 0x60
+		binary.BigEndian.PutUint16(b[4:6], plen)
+		b[6] = protoUDP
+		b[23], b[39] = 1, 2
+		return b
+	}
+	tests := []struct {
+		name    string
+		pkt     []byte
+		ok      bool
+		proto   byte
+		payload int
+	}{
+		{"ipv4", v4(5, 28, 0, 28), true, protoTCP, 8},
+		{"ipv4 padded", v4(5, 28, 0, 40), true, protoTCP, 8},
+		{"ipv4 options", v4(6, 32, 0, 32), true, protoTCP, 8},
+		{"ipv4 don't fragment", v4(5, 28, 0x4000, 28), true, protoTCP, 8},
+		{"ipv4 more fragments", v4(5, 28, 0x2000, 28), false, 0, 0},
+		{"ipv4 fragment offset", v4(5, 28, 0x0001, 28), false, 0, 0},
+		{"ipv4 short ihl", v4(4, 28, 0, 28), false, 0, 0},
+		{"ipv4 length beyond", v4(5, 40, 0, 28), false, 0, 0},
+		{"ipv4 length inside header", v4(6, 20, 0, 28), false, 0, 0},
+		{"ipv4 truncated", v4(5, 28, 0, 28)[:19], false, 0, 0},
+		{"ipv6", v6(8, 48), true, protoUDP, 8},
+		{"ipv6 padded", v6(8, 60), true, protoUDP, 8},
+		{"ipv6 length beyond", v6(9, 48), false, 0, 0},
+		{"ipv6 truncated", v6(0, 40)[:39], false, 0, 0},
+		{"version 5", append([]byte{0x50}, make([]byte, 40)...), false, 0, 0},
+		{"empty", nil, false, 0, 0},
+	}
+	for _, tt := range tests {
+		src, dst, proto, payload, ok := parseIP(tt.pkt)
+		if ok != tt.ok {
+			t.Errorf("%s: parseIP ok %v, want %v", tt.name, ok, tt.ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if proto != tt.proto || len(payload) != tt.payload {
+			t.Errorf("%s: parseIP proto %d payload %d, want %d %d", tt.name, proto, len(payload), tt.proto, tt.payload)
+		}
+		if src[len(src)-1] != 1 || dst[len(dst)-1] != 2 {
+			t.Errorf("%s: parseIP %s->%s", tt.name, src, dst)
+		}
+	}
+}
+
+func TestTunWrite(t *testing.T) {
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pr.Close()
+	defer pw.Close()
+	stack := &tunStack{dev: pw}
+	r := bufio.NewReader(pr)
+
+	tests := []struct {
+		src, dst net.IP
+		proto    byte
+		sum      int
+		size     int
+	}{
+		{net.IPv4(10, 0, 0, 1).To4(), net.IPv4(10, 0, 0, 2).To4(), protoTCP, 16, 20},
+		{net.IPv4(10, 0, 0, 1).To4(), net.IPv4(10, 0, 0, 2).To4(), protoTCP, 16, 25},
+		{net.IPv4(10, 0, 0, 1).To4(), net.IPv4(10, 0, 0, 2).To4(), protoUDP, 6, 8},
+		{net.ParseIP("fd00::1"), net.ParseIP("fd00::2"), protoTCP, 16, 33},
+		{net.ParseIP("fd00::1"), net.ParseIP("fd00::2"), protoUDP, 6, 13},
+	}
+	for _, tt := range tests {
+		transport := make([]byte, tt.size)
+		for i := range transport {
+			transport[i] = byte(i * 7)
+		}
+		if err := stack.write(tt.src, tt.dst, tt.proto, transport, tt.sum); err != nil {
+			t.Fatal(err)
+		}
+
+		hlen := 20
+		if tt.src.To4() == nil {
+			hlen = 40
+		}
+		pkt := make([]byte, hlen+tt.size)
+		if _, err := io.ReadFull(r, pkt); err != nil {
+			t.Fatal(err)
+		}
+		src, dst, proto, payload, ok := parseIP(pkt)
+		if !ok || !src.Equal(tt.src) || !dst.Equal(tt.dst) || proto != tt.proto || len(payload) != tt.size {
+			t.Errorf("write %s->%s %d: parsed %s->%s %d %d bytes, ok %v", tt.src, tt.dst, tt.proto, src, dst, proto, len(payload), ok)
+			continue
+		}
+		if hlen == 20 && fold(checksum(0, pkt[:20])) != 0xffff {
+			t.Errorf("write %s->%s: bad IPv4 header checksum", tt.src, tt.dst)
+		}
+		c := checksum(0, src)
+		c = checksum(c, dst)
+		c += uint32(proto) + uint32(len(payload))
+		if fold(checksum(c, payload)) != 0xffff {
+			t.Errorf("write %s->%s %d: bad transport checksum", tt.src, tt.dst, tt.proto)
+		}
+	}
+}
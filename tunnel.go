@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+)
+
+// Tunnel requests mirror the SOCKS5 request so the remote can serve
+// commands other than CONNECT, and are answered with a SOCKS5 reply
+// carrying the outcome. Legacy clients send the bare address, which
+// starts with ATYP instead of VER, and get no reply.
+// +----+-----+-------+------+----------+----------+
+// |VER | CMD |  RSV  | ATYP | DST.ADDR | DST.PORT |
+// +----+-----+-------+------+----------+----------+
+// | 1  |  1  | X'00' |  1   | Variable |    2     |
+// +----+-----+-------+------+----------+----------+
+
+const tunVer = 5
+
+const (
+	// cmdLegacy is a CONNECT from a legacy client, which expects no reply.
+	cmdLegacy = 0
+
+	// Commands private to the tunnel
+	cmdReverse = 0x10
+	cmdAccept  = 0x11
+	cmdDNS     = 0x12
+	cmdMux     = 0x13
+)
+
+func writeRequest(w io.Writer, cmd byte, addr *Addr) error {
+	_, err := w.Write(append([]byte{tunVer, cmd, 0}, addr.addr...))
+	return err
+}
+
+func readRequest(r io.Reader) (cmd byte, addr *Addr, err error) {
+	buf := make([]byte, 3)
+	if _, err := io.ReadFull(r, buf[:1]); err != nil {
+		return 0, nil, err
+	}
+	if buf[0] != tunVer {
+		addr, err = ReadAddr(io.MultiReader(bytes.NewReader(buf[:1]), r), "tcp")
+		return cmdLegacy, addr, err
+	}
+
+	if _, err := io.ReadFull(r, buf[1:3]); err != nil {
+		return 0, nil, err
+	}
+	cmd = buf[1]
+	network := "tcp"
+	if cmd == cmdUdp {
+		network = "udp"
+	}
+	addr, err = ReadAddr(r, network)
+	return cmd, addr, err
+}
+
+// readReply reads a reply written by reply and returns the bound address.
+func readReply(r io.Reader, network string) (*Addr, error) {
+	buf := make([]byte, 3)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	bnd, err := ReadAddr(r, network)
+	if err != nil {
+		return nil, err
+	}
+	if buf[1] != repSucceeded {
+		return bnd, repError(buf[1])
+	}
+	return bnd, nil
+}
+
+// Datagrams are carried on the tunnel as
+// +------+----------+----------+-----+----------+
+// | ATYP | DST.ADDR | DST.PORT | LEN |   DATA   |
+// +------+----------+----------+-----+----------+
+// |  1   | Variable |    2     |  2  | Variable |
+// +------+----------+----------+-----+----------+
+// and each one is written in a single frame.
+
+func writeDatagram(w io.Writer, addr *Addr, b []byte) error {
+	pkt := make([]byte, 0, len(addr.addr)+2+len(b))
+	pkt = append(pkt, addr.addr...)
+	pkt = append(pkt, byte(len(b)>>8), byte(len(b)))
+	pkt = append(pkt, b...)
+	_, err := w.Write(pkt)
+	return err
+}
+
+func readDatagram(r io.Reader, b []byte) (addr *Addr, n int, err error) {
+	if addr, err = ReadAddr(r, "udp"); err != nil {
+		return nil, 0, err
+	}
+	var l [2]byte
+	if _, err = io.ReadFull(r, l[:]); err != nil {
+		return nil, 0, err
+	}
+	n = int(binary.BigEndian.Uint16(l[:]))
+	if n > len(b) {
+		return nil, 0, io.ErrShortBuffer
+	}
+	if _, err = io.ReadFull(r, b[:n]); err != nil {
+		return nil, 0, err
+	}
+	return addr, n, nil
+}
+
+func udpAddr(a *Addr) (*net.UDPAddr, error) {
+	return net.ResolveUDPAddr("udp", a.String())
+}
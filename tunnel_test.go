@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestRequestRoundTrip(t *testing.T) {
+	tests := []struct {
+		cmd     byte
+		addr    string
+		network string
+	}{
+		{cmdConnect, "example.com:443", "tcp"},
+		{cmdLegacy, "192.0.2.1:80", "tcp"},
+		{cmdConnect, "[2001:db8::1]:8080", "tcp"},
+		{cmdBind, "192.0.2.1:0", "tcp"},
+		{cmdUdp, "192.0.2.1:53", "udp"},
+		{cmdReverse, "0.0.0.0:2222", "tcp"},
+		{cmdDNS, "0.0.0.0:0", "tcp"},
+		{cmdMux, "0.0.0.0:0", "tcp"},
+	}
+	for _, tt := range tests {
+		addr, err := NewAddr("tcp", tt.addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if err := writeRequest(&buf, tt.cmd, addr); err != nil {
+			t.Fatal(err)
+		}
+		cmd, got, err := readRequest(&buf)
+		if err != nil {
+			t.Errorf("readRequest(%#x %s): %v", tt.cmd, tt.addr, err)
+			continue
+		}
+		if cmd != tt.cmd || got.String() != addr.String() || got.Network() != tt.network {
+			t.Errorf("readRequest = %#x %s %s, want %#x %s %s", cmd, got.Network(), got, tt.cmd, tt.network, addr)
+		}
+		if buf.Len() != 0 {
+			t.Errorf("readRequest(%#x %s) left %d bytes", tt.cmd, tt.addr, buf.Len())
+		}
+	}
+}
+
+func TestReadRequest(t *testing.T) {
+	tests := []struct {
+		name string
+		req  []byte
+		cmd  byte
+		addr string
+		err  error
+	}{
+		{"legacy ipv4", []byte{atypIPv4, 192, 0, 2, 1, 0, 80}, cmdLegacy, "192.0.2.1:80", nil},
+		{"legacy domain", []byte{atypDomainName, 1, 'a', 1, 0xbb}, cmdLegacy, "a:443", nil},
+		{"bad atyp", []byte{tunVer, cmdConnect, 0, 9}, 0, "", errAddrType},
+		{"legacy bad atyp", []byte{9, 0, 0}, 0, "", errAddrType},
+		{"empty", nil, 0, "", io.EOF},
+		{"truncated header", []byte{tunVer, cmdConnect}, 0, "", io.ErrUnexpectedEOF},
+		{"truncated addr", []byte{tunVer, cmdConnect, 0, atypIPv4, 192, 0}, 0, "", io.ErrUnexpectedEOF},
+	}
+	for _, tt := range tests {
+		cmd, addr, err := readRequest(bytes.NewReader(tt.req))
+		if err != tt.err {
+			t.Errorf("%s: readRequest error %v, want %v", tt.name, err, tt.err)
+			continue
+		}
+		if err == nil && (cmd != tt.cmd || addr.String() != tt.addr) {
+			t.Errorf("%s: readRequest = %#x %s, want %#x %s", tt.name, cmd, addr, tt.cmd, tt.addr)
+		}
+	}
+}
+
+func TestReadReply(t *testing.T) {
+	tests := []struct {
+		rep  byte
+		want error
+	}{
+		{repSucceeded, nil},
+		{repNotAllowed, repError(repNotAllowed)},
+		{repConnRefused, repError(repConnRefused)},
+	}
+	bnd, _ := NewAddr("tcp", "198.51.100.7:1234")
+	for _, tt := range tests {
+		c, rc := net.Pipe()
+		go func(rep byte) {
+			reply(rc, rep, bnd)
+			rc.Close()
+		}(tt.rep)
+		got, err := readReply(c, "tcp")
+		c.Close()
+		if err != tt.want {
+			t.Errorf("readReply(%d) error %v, want %v", tt.rep, err, tt.want)
+		}
+		if got == nil || got.String() != bnd.String() {
+			t.Errorf("readReply(%d) bound %v, want %s", tt.rep, got, bnd)
+		}
+	}
+}
+
+func TestDatagramFraming(t *testing.T) {
+	tests := []struct {
+		addr string
+		data []byte
+	}{
+		{"192.0.2.1:53", []byte("query")},
+		{"[2001:db8::1]:443", bytes.Repeat([]byte{0xab}, 1200)},
+		{"example.com:123", nil},
+	}
+	var buf bytes.Buffer
+	for _, tt := range tests {
+		addr, _ := NewAddr("udp", tt.addr)
+		if err := writeDatagram(&buf, addr, tt.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Datagrams written back to back are read one at a time
+	b := make([]byte, 2048)
+	for _, tt := range tests {
+		addr, n, err := readDatagram(&buf, b)
+		if err != nil {
+			t.Fatalf("readDatagram(%s): %v", tt.addr, err)
+		}
+		if addr.String() != tt.addr || addr.Network() != "udp" || !bytes.Equal(b[:n], tt.data) {
+			t.Errorf("readDatagram = %s %d bytes, want %s %d bytes", addr, n, tt.addr, len(tt.data))
+		}
+	}
+
+	addr, _ := NewAddr("udp", "192.0.2.1:53")
+	writeDatagram(&buf, addr, make([]byte, 100))
+	if _, _, err := readDatagram(&buf, make([]byte, 99)); err != io.ErrShortBuffer {
+		t.Errorf("readDatagram into a short buffer: %v, want %v", err, io.ErrShortBuffer)
+	}
+}
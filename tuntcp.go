@@ -0,0 +1,573 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	tcpFIN = 0x01
+	tcpSYN = 0x02
+	tcpRST = 0x04
+	tcpPSH = 0x08
+	tcpACK = 0x10
+
+	tcpRecvBuf    = 64*1024 - 1 // no window scaling
+	tcpSendBuf    = 256 * 1024
+	tcpRTO        = time.Second
+	tcpMaxRTO     = 30 * time.Second
+	tcpMaxRetries = 8
+	tcpLinger     = 60 * time.Second
+	tcpMinMSS     = 64
+)
+
+var errTCPClosed = errors.New("tcp flow closed")
+
+// tcpFlow is the end of a TCP connection of the TUN device, standing for
+// its destination. Data is only accepted in order, anything else is
+// acknowledged with the next expected sequence so the peer retransmits.
+type tcpFlow struct {
+	stack *tunStack
+	key   string
+	src   *net.TCPAddr
+	dst   *net.TCPAddr
+	mss   int
+	irs   uint32 // initial sequence of the peer
+
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	// Receive side
+	rcvNxt  uint32
+	rbuf    []byte
+	lastWnd int
+	finRcvd bool
+
+	// Send side, unacked holding the data from sndUna on
+	iss         uint32
+	sndUna      uint32
+	sndNxt      uint32
+	sndWnd      uint32
+	unacked     []byte
+	established bool
+	finSent     bool
+	finAcked    bool
+	dupAcks     int
+
+	rto     time.Duration
+	retries int
+	rtimer  *time.Timer
+
+	closed bool
+	err    error // reset or aborted
+
+	rdl, wdl deadline
+}
+
+func (t *tunStack) inputTCP(src, dst net.IP, b []byte) {
+	// +------+------+-----+-----+-----------+-------+-----+-----+-----+
+	// | SRC  | DST  | SEQ | ACK | OFF/FLAGS | FLAGS | WND | SUM | URG |
+	// +------+------+-----+-----+-----------+-------+-----+-----+-----+
+	// |  2   |  2   |  4  |  4  |     1     |   1   |  2  |  2  |  2  |
+	// +------+------+-----+-----+-----------+-------+-----+-----+-----+
+	if len(b) < 20 {
+		return
+	}
+	off := int(b[12]>>4) * 4
+	if off < 20 || off > len(b) {
+		return
+	}
+	sport, dport := binary.BigEndian.Uint16(b[0:2]), binary.BigEndian.Uint16(b[2:4])
+	seq, ack := binary.BigEndian.Uint32(b[4:8]), binary.BigEndian.Uint32(b[8:12])
+	flags := b[13]
+	wnd := uint32(binary.BigEndian.Uint16(b[14:16]))
+
+	key := flowKey(src, sport, dst, dport)
+	t.mu.Lock()
+	f := t.tcp[key]
+	t.mu.Unlock()
+
+	if f != nil && flags&tcpSYN != 0 && flags&tcpACK == 0 && seq != f.irs {
+		f.abort(errTCPClosed) // the tuple is reused
+		f = nil
+	}
+	if f == nil {
+		if flags&tcpRST != 0 {
+			return
+		}
+		if flags&tcpSYN == 0 || flags&tcpACK != 0 {
+			t.reset(dst, dport, src, sport, ack, seq+uint32(len(b)-off), flags)
+			return
+		}
+		t.newTCPFlow(key, src, sport, dst, dport, seq, wnd, b[20:off])
+		return
+	}
+	f.input(seq, ack, flags, wnd, b[off:])
+}
+
+// reset answers a segment of no flow with a RST.
+func (t *tunStack) reset(src net.IP, sport uint16, dst net.IP, dport uint16, seq, ack uint32, flags byte) {
+	seg := make([]byte, 20)
+	binary.BigEndian.PutUint16(seg[0:2], sport)
+	binary.BigEndian.PutUint16(seg[2:4], dport)
+	seg[12] = 5 << 4
+	if flags&tcpACK != 0 {
+		binary.BigEndian.PutUint32(seg[4:8], seq)
+		seg[13] = tcpRST
+	} else {
+		binary.BigEndian.PutUint32(seg[8:12], ack)
+		seg[13] = tcpRST | tcpACK
+	}
+	t.write(src, dst, protoTCP, seg, 16)
+}
+
+func (t *tunStack) newTCPFlow(key string, src net.IP, sport uint16, dst net.IP, dport uint16, seq, wnd uint32, opts []byte) {
+	max := tunMTU - 40
+	if len(src) != net.IPv4len {
+		max = tunMTU - 60
+	}
+	mss := parseMSS(opts)
+	if mss > max {
+		mss = max
+	}
+
+	var b [4]byte
+	rand.Read(b[:])
+	iss := binary.BigEndian.Uint32(b[:])
+	f := &tcpFlow{
+		stack:   t,
+		key:     key,
+		src:     &net.TCPAddr{IP: append(net.IP(nil), src...), Port: int(sport)},
+		dst:     &net.TCPAddr{IP: append(net.IP(nil), dst...), Port: int(dport)},
+		mss:     mss,
+		irs:     seq,
+		rcvNxt:  seq + 1,
+		lastWnd: tcpRecvBuf,
+		iss:     iss,
+		sndUna:  iss,
+		sndNxt:  iss,
+		sndWnd:  wnd,
+		rto:     tcpRTO,
+	}
+	f.cond = sync.NewCond(&f.mu)
+
+	t.mu.Lock()
+	t.tcp[key] = f
+	t.mu.Unlock()
+
+	go t.serveTCPFlow(f)
+}
+
+// parseMSS finds the MSS option of a SYN, ignoring the other options. It
+// defaults to 536 when missing or too small for segments to carry data.
+func parseMSS(opts []byte) int {
+	mss := 536
+	for len(opts) > 0 {
+		switch opts[0] {
+		case 0:
+			opts = nil
+			continue
+		case 1:
+			opts = opts[1:]
+			continue
+		}
+		if len(opts) < 2 || int(opts[1]) < 2 || int(opts[1]) > len(opts) {
+			break
+		}
+		if opts[0] == 2 && opts[1] == 4 {
+			mss = int(binary.BigEndian.Uint16(opts[2:4]))
+		}
+		opts = opts[opts[1]:]
+	}
+	if mss < tcpMinMSS {
+		mss = 536
+	}
+	return mss
+}
+
+// serveTCPFlow routes f, answering the SYN once the outcome of the dial is
+// known so that failures reach the client as a reset.
+func (t *tunStack) serveTCPFlow(f *tcpFlow) {
+	defer f.Close()
+
+	s := t.srv
+	addr, err := NewAddr("tcp", f.dst.String())
+	if err != nil {
+		f.abort(err)
+		return
+	}
+	addr = s.realAddr(addr)
+	s.route(f, addr, s.away.ResloveMode(addr), func(_ *Addr, err error) error {
+		if err != nil {
+			f.abort(err)
+			return err
+		}
+		f.synAck()
+		return nil
+	})
+}
+
+func (f *tcpFlow) synAck() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil || f.sndNxt != f.iss {
+		return
+	}
+	f.sndNxt = f.iss + 1
+	f.send(tcpSYN|tcpACK, f.iss, nil)
+	f.armRetransmit()
+}
+
+// send writes a segment with the current acknowledgement and window,
+// f.mu held.
+func (f *tcpFlow) send(flags byte, seq uint32, data []byte) {
+	hl := 20
+	if flags&tcpSYN != 0 {
+		hl = 24
+	}
+	seg := make([]byte, hl+len(data))
+	binary.BigEndian.PutUint16(seg[0:2], uint16(f.dst.Port))
+	binary.BigEndian.PutUint16(seg[2:4], uint16(f.src.Port))
+	binary.BigEndian.PutUint32(seg[4:8], seq)
+	binary.BigEndian.PutUint32(seg[8:12], f.rcvNxt)
+	seg[12] = byte(hl/4) << 4
+	seg[13] = flags | tcpACK
+	wnd := tcpRecvBuf - len(f.rbuf)
+	binary.BigEndian.PutUint16(seg[14:16], uint16(wnd))
+	f.lastWnd = wnd
+	if flags&tcpSYN != 0 {
+		seg[20], seg[21] = 2, 4
+		binary.BigEndian.PutUint16(seg[22:24], uint16(f.mss))
+	}
+	copy(seg[hl:], data)
+	f.stack.write(f.dst.IP, f.src.IP, protoTCP, seg, 16)
+}
+
+func (f *tcpFlow) input(seq, ack uint32, flags byte, wnd uint32, data []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return
+	}
+	if flags&tcpRST != 0 {
+		f.fail(syscall.ECONNRESET)
+		return
+	}
+	if flags&tcpSYN != 0 { // retransmitted SYN
+		if f.sndNxt != f.iss && !f.established {
+			f.send(tcpSYN|tcpACK, f.iss, nil)
+		}
+		return
+	}
+	if flags&tcpACK == 0 || f.sndNxt == f.iss {
+		return
+	}
+
+	f.acked(ack, wnd, len(data) == 0 && flags&tcpFIN == 0)
+
+	// Trim what was already received
+	if d := int32(f.rcvNxt - seq); d > 0 {
+		if int(d) > len(data) || int(d) == len(data) && flags&tcpFIN == 0 {
+			if len(data) > 0 || flags&tcpFIN != 0 {
+				f.send(0, f.sndNxt, nil)
+			}
+			return
+		}
+		data, seq = data[d:], f.rcvNxt
+	}
+	if seq != f.rcvNxt || f.finRcvd && len(data) > 0 {
+		f.send(0, f.sndNxt, nil) // out of order, or past the FIN
+		return
+	}
+
+	if len(data) > 0 {
+		if f.closed {
+			f.fail(errTCPClosed)
+			f.send(tcpRST, f.sndNxt, nil)
+			return
+		}
+		n := tcpRecvBuf - len(f.rbuf)
+		if n > len(data) {
+			n = len(data)
+		}
+		f.rbuf = append(f.rbuf, data[:n]...)
+		f.rcvNxt += uint32(n)
+		if n < len(data) {
+			flags &^= tcpFIN
+		}
+		f.cond.Broadcast()
+	}
+	if flags&tcpFIN != 0 && !f.finRcvd {
+		f.finRcvd = true
+		f.rcvNxt++
+		f.cond.Broadcast()
+	}
+	if len(data) > 0 || flags&tcpFIN != 0 {
+		f.send(0, f.sndNxt, nil)
+	}
+	f.maybeDone()
+}
+
+// acked handles the acknowledgement of the peer, f.mu held.
+func (f *tcpFlow) acked(ack, wnd uint32, pure bool) {
+	f.sndWnd = wnd
+	n := ack - f.sndUna
+	if int32(n) <= 0 || n > f.sndNxt-f.sndUna {
+		if n == 0 && pure && len(f.unacked) > 0 {
+			if wnd == 0 {
+				f.retries = 0 // answering window probes
+			} else if f.dupAcks++; f.dupAcks == 3 { // fast retransmit
+				f.retransmit()
+			}
+		}
+		f.cond.Broadcast() // the window may have opened
+		return
+	}
+
+	f.sndUna = ack
+	f.dupAcks = 0
+	if !f.established {
+		f.established = true
+		n--
+	}
+	d := int(n)
+	if d > len(f.unacked) {
+		d = len(f.unacked)
+		f.finAcked = f.finSent
+	}
+	f.unacked = f.unacked[d:]
+
+	f.rto = tcpRTO
+	f.retries = 0
+	if f.sndUna == f.sndNxt {
+		f.rtimer.Stop()
+	} else {
+		f.rtimer.Reset(f.rto)
+	}
+	f.cond.Broadcast()
+}
+
+// armRetransmit starts the retransmission timer when stopped, f.mu held.
+func (f *tcpFlow) armRetransmit() {
+	if f.rtimer == nil {
+		f.rtimer = time.AfterFunc(f.rto, f.timeout)
+	} else if f.sndUna != f.sndNxt {
+		f.rtimer.Reset(f.rto)
+	}
+}
+
+func (f *tcpFlow) timeout() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil || f.sndUna == f.sndNxt {
+		return
+	}
+	if f.retries++; f.retries > tcpMaxRetries {
+		f.fail(syscall.ETIMEDOUT)
+		f.send(tcpRST, f.sndNxt, nil)
+		return
+	}
+	f.retransmit()
+	if f.rto *= 2; f.rto > tcpMaxRTO {
+		f.rto = tcpMaxRTO
+	}
+	f.rtimer.Reset(f.rto)
+}
+
+// retransmit resends the oldest unacknowledged segment, f.mu held.
+func (f *tcpFlow) retransmit() {
+	switch {
+	case !f.established:
+		f.send(tcpSYN|tcpACK, f.iss, nil)
+	case len(f.unacked) > 0:
+		n := len(f.unacked)
+		if n > f.mss {
+			n = f.mss
+		}
+		f.send(tcpPSH, f.sndUna, f.unacked[:n])
+	case f.finSent && !f.finAcked:
+		f.send(tcpFIN, f.sndNxt-1, nil)
+	}
+}
+
+// fail ends f with err, f.mu held.
+func (f *tcpFlow) fail(err error) {
+	if f.err == nil {
+		f.err = err
+	}
+	if f.rtimer != nil {
+		f.rtimer.Stop()
+	}
+	f.cond.Broadcast()
+	f.stack.removeTCP(f)
+}
+
+// abort resets the connection of the peer.
+func (f *tcpFlow) abort(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return
+	}
+	f.fail(err)
+	if f.sndNxt == f.iss { // SYN unanswered
+		f.stack.reset(f.dst.IP, uint16(f.dst.Port), f.src.IP, uint16(f.src.Port), 0, f.rcvNxt, 0)
+	} else {
+		f.send(tcpRST, f.sndNxt, nil)
+	}
+}
+
+// maybeDone forgets f once both sides are closed, f.mu held.
+func (f *tcpFlow) maybeDone() {
+	if f.finAcked && f.finRcvd {
+		f.fail(errTCPClosed)
+	}
+}
+
+func (t *tunStack) removeTCP(f *tcpFlow) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.tcp[f.key] == f {
+		delete(t.tcp, f.key)
+	}
+}
+
+func (f *tcpFlow) Read(b []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for {
+		switch {
+		case len(f.rbuf) > 0:
+			n := copy(b, f.rbuf)
+			f.rbuf = f.rbuf[n:]
+			if len(f.rbuf) == 0 {
+				f.rbuf = nil
+			}
+			if f.lastWnd < f.mss && tcpRecvBuf-len(f.rbuf) >= f.mss && f.err == nil {
+				f.send(0, f.sndNxt, nil) // window update
+			}
+			return n, nil
+		case f.finRcvd:
+			return 0, io.EOF
+		case f.err != nil:
+			return 0, f.err
+		case f.closed:
+			return 0, errTCPClosed
+		case f.rdl.exceeded():
+			return 0, os.ErrDeadlineExceeded
+		}
+		f.cond.Wait()
+	}
+}
+
+func (f *tcpFlow) Write(b []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := 0
+	for len(b) > 0 {
+		switch {
+		case f.err != nil:
+			return n, f.err
+		case f.closed || f.finSent:
+			return n, errTCPClosed
+		case f.wdl.exceeded():
+			return n, os.ErrDeadlineExceeded
+		}
+
+		room := int(f.sndWnd) - int(f.sndNxt-f.sndUna)
+		if r := tcpSendBuf - len(f.unacked); r < room {
+			room = r
+		}
+		if f.established && f.sndWnd == 0 && f.sndUna == f.sndNxt {
+			// Probe the closed window with a byte past it, retransmitted
+			// until acknowledged so that a lost window update can't stall
+			f.send(tcpPSH, f.sndNxt, b[:1])
+			f.unacked = append(f.unacked, b[0])
+			f.sndNxt++
+			b, n = b[1:], n+1
+			f.armRetransmit()
+			continue
+		}
+		if !f.established || room <= 0 {
+			f.cond.Wait()
+			continue
+		}
+
+		for room > 0 && len(b) > 0 {
+			l := len(b)
+			if l > f.mss {
+				l = f.mss
+			}
+			if l > room {
+				l = room
+			}
+			f.send(tcpPSH, f.sndNxt, b[:l])
+			f.unacked = append(f.unacked, b[:l]...)
+			f.sndNxt += uint32(l)
+			b, room, n = b[l:], room-l, n+l
+		}
+		f.armRetransmit()
+	}
+	return n, nil
+}
+
+// Close sends a FIN after the data written so far and keeps acknowledging
+// the peer until it closes too, or for tcpLinger at most.
+func (f *tcpFlow) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return nil
+	}
+	f.closed = true
+	f.cond.Broadcast()
+	if f.err != nil {
+		return nil
+	}
+	if f.sndNxt == f.iss { // SYN unanswered
+		f.fail(errTCPClosed)
+		f.stack.reset(f.dst.IP, uint16(f.dst.Port), f.src.IP, uint16(f.src.Port), 0, f.rcvNxt, 0)
+		return nil
+	}
+
+	f.finSent = true
+	f.send(tcpFIN, f.sndNxt, nil)
+	f.sndNxt++
+	f.armRetransmit()
+	f.maybeDone()
+	time.AfterFunc(tcpLinger, func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.fail(errTCPClosed)
+	})
+	return nil
+}
+
+func (f *tcpFlow) LocalAddr() net.Addr  { return f.dst }
+func (f *tcpFlow) RemoteAddr() net.Addr { return f.src }
+
+func (f *tcpFlow) SetDeadline(t time.Time) error {
+	f.SetReadDeadline(t)
+	return f.SetWriteDeadline(t)
+}
+
+func (f *tcpFlow) SetReadDeadline(t time.Time) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.rdl.set(t, f.cond)
+	return nil
+}
+
+func (f *tcpFlow) SetWriteDeadline(t time.Time) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.wdl.set(t, f.cond)
+	return nil
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseMSS(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []byte
+		want int
+	}{
+		{"none", nil, 536},
+		{"mss", []byte{2, 4, 0x05, 0x78}, 1400},
+		{"zero", []byte{2, 4, 0, 0}, 536},
+		{"tiny", []byte{2, 4, 0, 10}, 536},
+		{"minimum", []byte{2, 4, 0, 64}, 64},
+		{"after nops", []byte{1, 1, 2, 4, 0x05, 0xb4}, 1460},
+		{"after others", []byte{4, 2, 3, 3, 7, 2, 4, 0x04, 0x00}, 1024},
+		{"after eol", []byte{0, 2, 4, 0x05, 0xb4}, 536},
+		{"truncated", []byte{2, 4, 0x05}, 536},
+		{"bad length", []byte{2, 1, 0x05, 0xb4}, 536},
+		{"wrong length", []byte{2, 3, 0x05, 0xb4}, 536},
+	}
+	for _, tt := range tests {
+		if got := parseMSS(tt.opts); got != tt.want {
+			t.Errorf("%s: parseMSS(%v) = %d, want %d", tt.name, tt.opts, got, tt.want)
+		}
+	}
+}
+
+type testSegment struct {
+	seq, ack uint32
+	flags    byte
+	wnd      uint16
+	data     []byte
+}
+
+// readSegment reads the next IPv4 TCP packet written by a tunStack.
+func readSegment(t *testing.T, r *bufio.Reader) testSegment {
+	hdr := make([]byte, 20)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		t.Fatal(err)
+	}
+	pkt := make([]byte, int(binary.BigEndian.Uint16(hdr[2:4]))-20)
+	if _, err := io.ReadFull(r, pkt); err != nil {
+		t.Fatal(err)
+	}
+	off := int(pkt[12]>>4) * 4
+	return testSegment{
+		seq:   binary.BigEndian.Uint32(pkt[4:8]),
+		ack:   binary.BigEndian.Uint32(pkt[8:12]),
+		flags: pkt[13],
+		wnd:   binary.BigEndian.Uint16(pkt[14:16]),
+		data:  pkt[off:],
+	}
+}
+
+func newTestFlow(t *testing.T, wnd uint32) (*tcpFlow, *bufio.Reader) {
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		pw.Close()
+		pr.Close()
+	})
+	f := &tcpFlow{
+		stack:       &tunStack{dev: pw, tcp: make(map[string]*tcpFlow)},
+		src:         &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1).To4(), Port: 40000},
+		dst:         &net.TCPAddr{IP: net.IPv4(10, 0, 0, 2).To4(), Port: 80},
+		mss:         1000,
+		irs:         5000,
+		rcvNxt:      5001,
+		lastWnd:     tcpRecvBuf,
+		iss:         1000,
+		sndUna:      1001,
+		sndNxt:      1001,
+		sndWnd:      wnd,
+		established: true,
+		rto:         tcpRTO,
+	}
+	f.cond = sync.NewCond(&f.mu)
+	t.Cleanup(func() { f.abort(errTCPClosed) })
+	return f, bufio.NewReader(pr)
+}
+
+func TestTCPFlowSegments(t *testing.T) {
+	f, r := newTestFlow(t, 64*1024)
+	data := make([]byte, 2500)
+	if n, err := f.Write(data); n != len(data) || err != nil {
+		t.Fatalf("Write = %d, %v", n, err)
+	}
+	seq := uint32(1001)
+	for _, want := range []int{1000, 1000, 500} {
+		seg := readSegment(t, r)
+		if seg.seq != seq || len(seg.data) != want || seg.ack != 5001 {
+			t.Fatalf("segment seq %d len %d ack %d, want seq %d len %d ack 5001",
+				seg.seq, len(seg.data), seg.ack, seq, want)
+		}
+		seq += uint32(want)
+	}
+}
+
+func TestTCPFlowZeroWindowProbe(t *testing.T) {
+	f, r := newTestFlow(t, 0)
+	done := make(chan int)
+	go func() {
+		n, _ := f.Write([]byte("hello"))
+		done <- n
+	}()
+
+	probe := readSegment(t, r)
+	if probe.seq != 1001 || string(probe.data) != "h" {
+		t.Fatalf("probe seq %d data %q, want seq 1001 data \"h\"", probe.seq, probe.data)
+	}
+
+	// The window update is lost: the probe is retransmitted
+	f.mu.Lock()
+	f.rtimer.Reset(10 * time.Millisecond)
+	f.mu.Unlock()
+	if again := readSegment(t, r); again.seq != 1001 || string(again.data) != "h" {
+		t.Fatalf("retransmitted probe seq %d data %q", again.seq, again.data)
+	}
+
+	f.input(5001, 1002, tcpACK, 1000, nil)
+	rest := readSegment(t, r)
+	if rest.seq != 1002 || string(rest.data) != "ello" {
+		t.Fatalf("segment seq %d data %q, want seq 1002 data \"ello\"", rest.seq, rest.data)
+	}
+	select {
+	case n := <-done:
+		if n != 5 {
+			t.Fatalf("Write = %d, want 5", n)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Write blocked")
+	}
+}
+
+func TestTCPFlowProbeAnswersKeepFlow(t *testing.T) {
+	f, r := newTestFlow(t, 0)
+	go f.Write([]byte("x"))
+	readSegment(t, r)
+
+	f.mu.Lock()
+	f.retries = tcpMaxRetries
+	f.mu.Unlock()
+	f.input(5001, 1001, tcpACK, 0, nil) // window still closed
+
+	f.mu.Lock()
+	retries, err := f.retries, f.err
+	f.mu.Unlock()
+	if retries != 0 || err != nil {
+		t.Fatalf("retries %d err %v after a probe answer, want 0 <nil>", retries, err)
+	}
+}
+
+func TestTCPFlowInput(t *testing.T) {
+	f, r := newTestFlow(t, 64*1024)
+	steps := []struct {
+		name  string
+		seq   uint32
+		flags byte
+		data  string
+		ack   uint32 // acknowledged in reply, 0 for no reply
+		rbuf  string
+	}{
+		{"in order", 5001, tcpACK, "abc", 5004, "abc"},
+		{"duplicate", 5001, tcpACK, "abc", 5004, "abc"},
+		{"overlap", 5002, tcpACK, "bcde", 5006, "abcde"},
+		{"out of order", 5010, tcpACK, "xyz", 5006, "abcde"},
+		{"pure ack", 5006, tcpACK, "", 0, "abcde"},
+		{"no ack flag", 5006, 0, "f", 0, "abcde"},
+		{"fin", 5006, tcpACK | tcpFIN, "f", 5008, "abcdef"},
+		{"after fin", 5008, tcpACK, "g", 5008, "abcdef"},
+	}
+	for _, st := range steps {
+		f.input(st.seq, 1001, st.flags, 64*1024, []byte(st.data))
+		if st.ack != 0 {
+			if seg := readSegment(t, r); seg.ack != st.ack || len(seg.data) != 0 {
+				t.Fatalf("%s: replied ack %d with %d bytes, want ack %d", st.name, seg.ack, len(seg.data), st.ack)
+			}
+		}
+		f.mu.Lock()
+		rbuf := string(f.rbuf)
+		f.mu.Unlock()
+		if rbuf != st.rbuf {
+			t.Fatalf("%s: received %q, want %q", st.name, rbuf, st.rbuf)
+		}
+	}
+
+	b := make([]byte, 16)
+	if n, err := f.Read(b); string(b[:n]) != "abcdef" || err != nil {
+		t.Fatalf("Read = %q, %v", b[:n], err)
+	}
+	if _, err := f.Read(b); err != io.EOF {
+		t.Fatalf("Read after FIN: %v, want EOF", err)
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	udpBufSize = 64 * 1024
+	udpTimeout = 60 * time.Second
+)
+
+// UDP request header https://tools.ietf.org/html/rfc1928#section-7
+// +----+------+------+----------+----------+----------+
+// |RSV | FRAG | ATYP | DST.ADDR | DST.PORT |   DATA   |
+// +----+------+------+----------+----------+----------+
+// | 2  |  1   |  1   | Variable |    2     | Variable |
+// +----+------+------+----------+----------+----------+
+
+type udpAssoc struct {
+	srv  *SocksSrv
+	addr *Addr
+	mode rune
+	lc   *net.UDPConn
+	ip   net.IP
+
+	mu     sync.Mutex
+	client *net.UDPAddr
+	direct *net.UDPConn
+	remote net.Conn
+	closed bool
+}
+
+// associate serves a UDP ASSOCIATE request until the control connection closes.
+func (s *SocksSrv) associate(oc net.Conn, addr *Addr, mode rune) {
+	oc.SetDeadline(time.Time{}) // handshake done
+	lc, err := net.ListenUDP("udp", &net.UDPAddr{IP: connIP(oc.LocalAddr())})
+	if err != nil {
+		log.Warn("UDP listen failure: ", err)
+		reply(oc, repGeneralFailure, nil)
+		return
+	}
+	bnd, err := NewAddr("udp", lc.LocalAddr().String())
+	if err != nil {
+		lc.Close()
+		reply(oc, repGeneralFailure, nil)
+		return
+	}
+	if _, err := reply(oc, repSucceeded, bnd); err != nil {
+		lc.Close()
+		return
+	}
+
+	ua := &udpAssoc{srv: s, addr: addr, mode: mode, lc: lc, ip: connIP(oc.RemoteAddr())}
+	defer ua.close()
+	go ua.serve()
+
+	log.Infof("UDP %s->%s", clientName(oc), bnd.String())
+	io.Copy(ioutil.Discard, oc)
+}
+
+func (ua *udpAssoc) close() {
+	ua.mu.Lock()
+	defer ua.mu.Unlock()
+	ua.closed = true
+	ua.lc.Close()
+	if ua.direct != nil {
+		ua.direct.Close()
+	}
+	if ua.remote != nil {
+		ua.remote.Close()
+	}
+}
+
+func (ua *udpAssoc) serve() {
+	buf := make([]byte, udpBufSize)
+	for {
+		n, from, err := ua.lc.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if !ua.ip.Equal(from.IP) {
+			continue
+		}
+		if n < 4 || buf[2] != 0 { // fragmentation is not supported
+			continue
+		}
+		addr, err := ReadAddr(bytes.NewReader(buf[3:n]), "udp")
+		if err != nil {
+			continue
+		}
+		data := buf[3+len(addr.addr) : n]
+		addr = ua.srv.realAddr(addr)
+
+		ua.mu.Lock()
+		ua.client = from
+		ua.mu.Unlock()
+
+		switch m := ua.srv.away.ResloveModeWith(ua.mode, addr); m {
+		case ModeDrop:
+		case ModeAway:
+			err = ua.sendRemote(addr, data)
+		default:
+			err = ua.sendDirect(addr, data)
+		}
+		if err != nil {
+			log.Warnf("UDP %s failure: %s", addr.String(), err)
+		}
+	}
+}
+
+func (ua *udpAssoc) sendDirect(addr *Addr, data []byte) error {
+	to, err := udpAddr(addr)
+	if err != nil {
+		return err
+	}
+
+	ua.mu.Lock()
+	dc := ua.direct
+	if dc == nil && !ua.closed {
+		if dc, err = net.ListenUDP("udp", nil); err != nil {
+			ua.mu.Unlock()
+			return err
+		}
+		ua.direct = dc
+		go ua.readDirect(dc)
+	}
+	ua.mu.Unlock()
+	if dc == nil {
+		return io.ErrClosedPipe
+	}
+
+	_, err = dc.WriteToUDP(data, to)
+	return err
+}
+
+func (ua *udpAssoc) readDirect(dc *net.UDPConn) {
+	buf := make([]byte, udpBufSize)
+	for {
+		n, from, err := dc.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		src, err := NewAddr("udp", from.String())
+		if err != nil {
+			continue
+		}
+		ua.toClient(src, buf[:n])
+	}
+}
+
+func (ua *udpAssoc) sendRemote(addr *Addr, data []byte) error {
+	ua.mu.Lock()
+	defer ua.mu.Unlock()
+	if ua.closed {
+		return io.ErrClosedPipe
+	}
+	if ua.remote == nil {
+		rc, _, err := ua.srv.dialTunnel(cmdUdp, ua.addr)
+		if err != nil {
+			return err
+		}
+		ua.remote = rc
+		go ua.readRemote(rc)
+	}
+	return writeDatagram(ua.remote, addr, data)
+}
+
+func (ua *udpAssoc) readRemote(rc net.Conn) {
+	defer func() {
+		ua.mu.Lock()
+		if ua.remote == rc {
+			ua.remote = nil
+		}
+		ua.mu.Unlock()
+		rc.Close()
+	}()
+
+	buf := make([]byte, udpBufSize)
+	for {
+		src, n, err := readDatagram(rc, buf)
+		if err != nil {
+			return
+		}
+		ua.toClient(src, buf[:n])
+	}
+}
+
+func (ua *udpAssoc) toClient(src *Addr, data []byte) {
+	ua.mu.Lock()
+	client := ua.client
+	ua.mu.Unlock()
+	if client == nil {
+		return
+	}
+
+	pkt := make([]byte, 0, 3+len(src.addr)+len(data))
+	pkt = append(pkt, 0, 0, 0)
+	pkt = append(pkt, src.addr...)
+	pkt = append(pkt, data...)
+	ua.lc.WriteToUDP(pkt, client)
+}
+
+// relayUDP serves an UDP tunnel on the remote, sending datagrams to their
+// targets and returning responses tagged with their source address.
+func relayUDP(wss net.Conn) {
+	uc, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		log.Warn("UDP listen failure: ", err)
+		reply(wss, repGeneralFailure, nil)
+		return
+	}
+	defer uc.Close()
+
+	bnd, err := NewAddr("udp", uc.LocalAddr().String())
+	if err != nil {
+		reply(wss, repGeneralFailure, nil)
+		return
+	}
+	if _, err := reply(wss, repSucceeded, bnd); err != nil {
+		return
+	}
+
+	idle := time.AfterFunc(udpTimeout, func() {
+		uc.Close()
+		wss.Close()
+	})
+	defer idle.Stop()
+
+	var nin, nout int64
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		buf := make([]byte, udpBufSize)
+		for {
+			n, from, err := uc.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			idle.Reset(udpTimeout)
+			src, err := NewAddr("udp", from.String())
+			if err != nil {
+				continue
+			}
+			if err := writeDatagram(wss, src, buf[:n]); err != nil {
+				return
+			}
+			nin += int64(n)
+		}
+	}()
+
+	buf := make([]byte, udpBufSize)
+	for {
+		dst, n, err := readDatagram(wss, buf)
+		if err != nil {
+			break
+		}
+		idle.Reset(udpTimeout)
+		to, err := udpAddr(dst)
+		if err != nil {
+			log.Warn("UDP resolve failure: ", err)
+			continue
+		}
+		if _, err := uc.WriteToUDP(buf[:n], to); err != nil {
+			log.Warn("UDP write failure: ", err)
+			continue
+		}
+		nout += int64(n)
+	}
+	uc.Close()
+	<-done
+	log.Infof("Away UDP: %s ~ %s <%d %d>", clientName(wss), bnd.String(), nin, nout)
+}